@@ -0,0 +1,291 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package lru
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/greivinlopez/skue"
+	"sync"
+	"time"
+)
+
+// ErrMiss is returned by Get when the key is not cached or it expired.
+var ErrMiss = skue.ErrCacheMiss
+
+// NoExpiration is the TTL of the values that never expire.
+const NoExpiration time.Duration = -1
+
+// Options sets the bounds of an LRUCacher. Zero values mean no bound.
+type Options struct {
+	MaxEntries int           // Maximum number of cached values
+	MaxBytes   int64         // Maximum size of the cached values once encoded
+	TTL        time.Duration // Time to live of the values set without one, no expiration by default
+
+	Codec              skue.Codec // Encodes the cached values, skue.JSONCodec by default
+	CompressionMinSize int        // Minimum size of the values to be compressed, zero for none
+}
+
+// Stats counts what happened to the cached values since the cacher was
+// created.
+type Stats struct {
+	Hits        int64 // Gets that found the key
+	Misses      int64 // Gets that did not find the key, expired keys included
+	Sets        int64 // Values cached
+	Evictions   int64 // Values removed to respect the bounds of the cacher
+	Expirations int64 // Values removed because they expired
+	Entries     int   // Values currently cached
+	Bytes       int64 // Size of the values currently cached
+}
+
+// The LRUCacher is an implementation of the MemoryCacher interface.
+// See more about MemoryCacher here:
+//   https://github.com/greivinlopez/skue
+// It keeps the values in the memory of the process, so small services can
+// cache their models without a Redis server. When the cacher is full the
+// least recently used values are evicted.
+// Values are stored encoded with the codec of the options, just like the
+// RedisCacher does, so callers can not change the cached values through
+// their own copies.
+// It is safe for concurrent use.
+type LRUCacher struct {
+	mutex   sync.Mutex
+	options Options
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+	stats   Stats
+}
+
+// entry is a cached value.
+type entry struct {
+	key     string
+	data    []byte
+	expires time.Time // Zero for values that never expire
+}
+
+// New creates a new LRUCacher with the given bounds.
+func New(options Options) *LRUCacher {
+	return &LRUCacher{
+		options: options,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// cacheKey returns the string key for any key.
+func cacheKey(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	return fmt.Sprint(key)
+}
+
+// remove removes the element from the cacher. The lock must be held.
+func (cacher *LRUCacher) remove(element *list.Element) {
+	current := element.Value.(*entry)
+	cacher.order.Remove(element)
+	delete(cacher.entries, current.key)
+	cacher.stats.Bytes -= int64(len(current.data))
+}
+
+// full reports whether the cacher is over its bounds. The lock must be held.
+func (cacher *LRUCacher) full() bool {
+	return (cacher.options.MaxEntries > 0 && cacher.order.Len() > cacher.options.MaxEntries) ||
+		(cacher.options.MaxBytes > 0 && cacher.stats.Bytes > cacher.options.MaxBytes)
+}
+
+// encoding returns the encoding of the values of the cacher.
+func (cacher *LRUCacher) encoding() skue.ValueEncoding {
+	return skue.ValueEncoding{
+		Codec:              cacher.options.Codec,
+		CompressionMinSize: cacher.options.CompressionMinSize,
+	}
+}
+
+// SetWithTTL caches the value for the given time to live instead of the one
+// given by the options. A ttl of 0 uses the options, NoExpiration keeps the
+// value until it is deleted. Values bigger than MaxBytes are not cached,
+// and the value cached before for the key is removed so it is not read
+// instead.
+func (cacher *LRUCacher) SetWithTTL(key interface{}, value interface{}, ttl time.Duration) error {
+	data, err := cacher.encoding().Encode(value)
+	if err != nil {
+		return err
+	}
+	current := &entry{key: cacheKey(key), data: data}
+	if ttl == 0 {
+		ttl = cacher.options.TTL
+	}
+	if ttl > 0 {
+		current.expires = time.Now().Add(ttl)
+	}
+
+	cacher.mutex.Lock()
+	defer cacher.mutex.Unlock()
+	if element, found := cacher.entries[current.key]; found {
+		cacher.remove(element)
+	}
+	if cacher.options.MaxBytes > 0 && int64(len(data)) > cacher.options.MaxBytes {
+		return nil
+	}
+	cacher.entries[current.key] = cacher.order.PushFront(current)
+	cacher.stats.Bytes += int64(len(data))
+	cacher.stats.Sets++
+	// Expired values go first, then the least recently used ones
+	now := time.Now()
+	for element := cacher.order.Back(); element != nil && cacher.full(); {
+		previous := element.Prev()
+		if expires := element.Value.(*entry).expires; !expires.IsZero() && now.After(expires) {
+			cacher.remove(element)
+			cacher.stats.Expirations++
+		}
+		element = previous
+	}
+	for cacher.full() {
+		cacher.remove(cacher.order.Back())
+		cacher.stats.Evictions++
+	}
+	return nil
+}
+
+// Purge removes all the cached values.
+func (cacher *LRUCacher) Purge() {
+	cacher.mutex.Lock()
+	defer cacher.mutex.Unlock()
+	cacher.order.Init()
+	cacher.entries = map[string]*list.Element{}
+	cacher.stats.Bytes = 0
+}
+
+// Stats returns the statistics of the cacher.
+func (cacher *LRUCacher) Stats() Stats {
+	cacher.mutex.Lock()
+	defer cacher.mutex.Unlock()
+	stats := cacher.stats
+	stats.Entries = cacher.order.Len()
+	return stats
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.MemoryCacher implementation
+// ----------------------------------------------------------------------------
+
+// Set caches the value for the TTL of the cacher.
+func (cacher *LRUCacher) Set(key interface{}, value interface{}) error {
+	return cacher.SetWithTTL(key, value, 0)
+}
+
+// Get decodes the cached value into the given pointer. Returns ErrMiss if
+// the key is not cached or it expired.
+func (cacher *LRUCacher) Get(key interface{}, entityPointer interface{}) error {
+	_, err := cacher.get(key, entityPointer)
+	return err
+}
+
+// get decodes the cached value into the given pointer and returns when it
+// expires.
+func (cacher *LRUCacher) get(key interface{}, entityPointer interface{}) (time.Time, error) {
+	cacher.mutex.Lock()
+	element, found := cacher.entries[cacheKey(key)]
+	if found {
+		if expires := element.Value.(*entry).expires; !expires.IsZero() && time.Now().After(expires) {
+			cacher.remove(element)
+			cacher.stats.Expirations++
+			found = false
+		}
+	}
+	if !found {
+		cacher.stats.Misses++
+		cacher.mutex.Unlock()
+		return time.Time{}, ErrMiss
+	}
+	cacher.order.MoveToFront(element)
+	cacher.stats.Hits++
+	current := element.Value.(*entry)
+	cacher.mutex.Unlock()
+
+	return current.expires, cacher.encoding().Decode(current.data, entityPointer)
+}
+
+// Delete removes the key from the cacher.
+func (cacher *LRUCacher) Delete(key interface{}) error {
+	cacher.mutex.Lock()
+	defer cacher.mutex.Unlock()
+	if element, found := cacher.entries[cacheKey(key)]; found {
+		cacher.remove(element)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.ContextMemoryCacher implementation
+// ----------------------------------------------------------------------------
+
+func (cacher *LRUCacher) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cacher.Set(key, value)
+}
+
+func (cacher *LRUCacher) GetContext(ctx context.Context, key interface{}, entityPointer interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cacher.Get(key, entityPointer)
+}
+
+func (cacher *LRUCacher) DeleteContext(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cacher.Delete(key)
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.ExpiringCacher implementation
+// ----------------------------------------------------------------------------
+
+// GetWithTTLContext decodes the cached value into the given pointer and
+// returns the time it remains cached, negative if it never expires.
+func (cacher *LRUCacher) GetWithTTLContext(ctx context.Context, key interface{}, entityPointer interface{}) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	expires, err := cacher.get(key, entityPointer)
+	if err != nil {
+		return 0, err
+	}
+	if expires.IsZero() {
+		return -1, nil
+	}
+	return time.Until(expires), nil
+}
+
+// SetWithTTLContext caches the value like SetWithTTL, unless the context is
+// done.
+func (cacher *LRUCacher) SetWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cacher.SetWithTTL(key, value, ttl)
+}
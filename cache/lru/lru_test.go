@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package lru
+
+import (
+	"context"
+	"errors"
+	"github.com/greivinlopez/skue"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEviction(t *testing.T) {
+	cacher := New(Options{MaxEntries: 2})
+	cacher.Set("a", 1)
+	cacher.Set("b", 2)
+	// Reading "a" makes "b" the least recently used
+	if err := cacher.Get("a", new(int)); err != nil {
+		t.Fatal(err)
+	}
+	cacher.Set("c", 3)
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		err := cacher.Get(key, new(int))
+		if cached && err != nil {
+			t.Errorf("got %v reading %q, want it cached", err, key)
+		} else if !cached && !errors.Is(err, skue.ErrCacheMiss) {
+			t.Errorf("got %v reading %q, want it evicted", err, key)
+		}
+	}
+	if stats := cacher.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("got %+v, want 1 eviction and 2 entries", stats)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	cacher := New(Options{MaxBytes: 64})
+	if err := cacher.Set("name", "Keylor"); err != nil {
+		t.Fatal(err)
+	}
+	// A value too big is not cached, and the one cached before is removed
+	if err := cacher.Set("name", strings.Repeat("Keylor", 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cacher.Get("name", new(string)); !errors.Is(err, ErrMiss) {
+		t.Errorf("got %v, want the oversized value and the stale one not cached", err)
+	}
+	if stats := cacher.Stats(); stats.Bytes != 0 || stats.Entries != 0 {
+		t.Errorf("got %+v, want nothing cached", stats)
+	}
+
+	cacher.Set("a", strings.Repeat("a", 30))
+	cacher.Set("b", strings.Repeat("b", 30))
+	if err := cacher.Get("a", new(string)); !errors.Is(err, ErrMiss) {
+		t.Errorf("got %v, want the least recently used value evicted", err)
+	}
+	if stats := cacher.Stats(); stats.Bytes > 64 {
+		t.Errorf("got %d bytes cached, want at most 64", stats.Bytes)
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	cacher := New(Options{TTL: 20 * time.Millisecond})
+	ctx := context.Background()
+	cacher.Set("short", 1)
+	cacher.SetWithTTL("forever", 2, NoExpiration)
+
+	ttl, err := cacher.GetWithTTLContext(ctx, "short", new(int))
+	if err != nil || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Errorf("got %v, %v, want a TTL up to 20ms", ttl, err)
+	}
+	ttl, err = cacher.GetWithTTLContext(ctx, "forever", new(int))
+	if err != nil || ttl != NoExpiration {
+		t.Errorf("got %v, %v, want NoExpiration for a value that never expires", ttl, err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err = cacher.Get("short", new(int)); !errors.Is(err, ErrMiss) {
+		t.Errorf("got %v, want the value expired", err)
+	}
+	value := 0
+	if err = cacher.Get("forever", &value); err != nil || value != 2 {
+		t.Errorf("got %d, %v, want 2", value, err)
+	}
+
+	stats := cacher.Stats()
+	want := Stats{Hits: 3, Misses: 1, Sets: 2, Expirations: 1, Entries: 1, Bytes: stats.Bytes}
+	if stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestContextDone(t *testing.T) {
+	cacher := New(Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cacher.SetContext(ctx, "a", 1); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if _, err := cacher.GetWithTTLContext(ctx, "a", new(int)); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,51 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// This work uses "msgpack" package by Vladimir Mihailenco:
+//
+//    https://github.com/vmihailenco/msgpack
+//
+// It is licensed under the BSD 2-Clause License.
+package rcache
+
+import (
+	"github.com/greivinlopez/skue"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// MsgpackCodec is a skue.Codec encoding the values with MessagePack:
+//   http://msgpack.org/
+// Values are smaller than with JSON and integers are kept as integers.
+var MsgpackCodec skue.Codec = msgpackCodec{}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Version() byte {
+	return 3
+}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	return msgpack.Marshal(value)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	return msgpack.Unmarshal(data, value)
+}
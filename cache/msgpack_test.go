@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package rcache
+
+import (
+	"errors"
+	"github.com/greivinlopez/skue"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type team struct {
+	Name    string
+	Founded int
+	Players []string
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	value := team{Name: "Saprissa", Founded: 1935, Players: []string{strings.Repeat("Keylor ", 20)}}
+	for _, minSize := range []int{0, 64} {
+		encoding := skue.ValueEncoding{Codec: MsgpackCodec, CompressionMinSize: minSize}
+		data, err := encoding.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data[0]&0x7f != MsgpackCodec.Version() {
+			t.Errorf("got version %d, want %d", data[0]&0x7f, MsgpackCodec.Version())
+		}
+		decoded := team{}
+		if err = encoding.Decode(data, &decoded); err != nil {
+			t.Errorf("compression from %d: unexpected error %v", minSize, err)
+		} else if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("compression from %d: got %+v, want %+v", minSize, decoded, value)
+		}
+	}
+}
+
+func TestDecodeOtherCodec(t *testing.T) {
+	value := team{Name: "Saprissa", Founded: 1935}
+	tests := []struct {
+		name    string
+		written skue.Codec
+		read    skue.Codec
+	}{
+		{"msgpack read as json", MsgpackCodec, nil},
+		{"json read as msgpack", skue.JSONCodec, MsgpackCodec},
+		{"gob read as msgpack", skue.GobCodec, MsgpackCodec},
+	}
+	for _, test := range tests {
+		data, err := skue.ValueEncoding{Codec: test.written}.Encode(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cacher := NewWithOptions(Options{Codec: test.read})
+		err = cacher.decode(data, &team{})
+		if !errors.Is(err, ErrMiss) || !errors.Is(err, skue.ErrCacheMiss) {
+			t.Errorf("%s: got %v, want a cache miss", test.name, err)
+		}
+	}
+
+	cacher := NewWithOptions(Options{Codec: MsgpackCodec})
+	err := cacher.decode([]byte{MsgpackCodec.Version(), 0xc1}, &team{})
+	if !errors.Is(err, ErrSerialization) {
+		t.Errorf("got %v decoding an invalid value, want ErrSerialization", err)
+	}
+}
@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// This work uses "Redigo" package by Gary Burd:
+//
+//    https://github.com/garyburd/redigo
+//
+// --------------  Redigo License --------------
+//
+// Copyright 2012 Gary Burd
+//
+// Licensed under the Apache License, Version 2.0 (the "License"): you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+// WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+// License for the specific language governing permissions and limitations
+// under the License.
+package rcache
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/greivinlopez/skue"
+	"time"
+)
+
+// RateLimitStore is an implementation of the skue.RateLimitStore interface
+// backed by Redis, so all the instances of an API share the same limits.
+// It counts the requests of each client with the sliding window counter
+// algorithm: the number of requests in the last window is estimated from
+// the counters of the current and the previous fixed windows. Only the
+// allowed requests are counted, so the clients going over the limit are let
+// in again as soon as the estimation goes down.
+type RateLimitStore struct {
+	cacher *RedisCacher
+	prefix string
+}
+
+// takeScript counts a request in the current window only when the estimated
+// count is below the limit, checking and counting atomically. It returns
+// whether the request is allowed and the counters of both windows.
+var takeScript = redis.NewScript(2, `
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+local allowed = 0
+if previous * (1 - tonumber(ARGV[1])) + count + 1 <= tonumber(ARGV[2]) then
+	count = redis.call("INCR", KEYS[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	allowed = 1
+end
+return {allowed, count, previous}
+`)
+
+// NewRateLimitStore creates a new RateLimitStore using the connections of
+// the given cacher. The counters are stored with the "ratelimit-" prefix.
+func NewRateLimitStore(cacher *RedisCacher) *RateLimitStore {
+	return &RateLimitStore{
+		cacher: cacher,
+		prefix: "ratelimit-",
+	}
+}
+
+// Take tells whether a new request of the client is allowed, counting it
+// when it is.
+func (store *RateLimitStore) Take(key string, limit int, window time.Duration) (skue.RateLimit, error) {
+	c, err := store.cacher.dial()
+	if err != nil {
+		return skue.RateLimit{}, classify(err)
+	}
+	defer c.Close()
+
+	now := time.Now()
+	current := now.UnixNano() / int64(window)
+	elapsed := float64(now.UnixNano()%int64(window)) / float64(window)
+	currentKey := fmt.Sprintf("%s%s-%d", store.prefix, key, current)
+	previousKey := fmt.Sprintf("%s%s-%d", store.prefix, key, current-1)
+
+	values, err := redis.Ints(takeScript.Do(c, currentKey, previousKey,
+		elapsed, limit, int64(2*window/time.Millisecond)))
+	if err != nil {
+		return skue.RateLimit{}, classify(err)
+	}
+	allowed, count, previous := values[0] == 1, values[1], values[2]
+
+	estimated := float64(previous)*(1-elapsed) + float64(count)
+	if allowed {
+		return skue.RateLimit{Allowed: true, Remaining: int(float64(limit) - estimated)}, nil
+	}
+	// The estimation goes down as the previous window slides away, and it
+	// is reset by the next window when this one is already full
+	wait := time.Duration((1 - elapsed) * float64(window))
+	if count < limit && previous > 0 {
+		needed := 1 - float64(limit-count-1)/float64(previous)
+		wait = time.Duration((needed - elapsed) * float64(window))
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return skue.RateLimit{Allowed: false, Remaining: 0, RetryAfter: wait}, nil
+}
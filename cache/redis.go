@@ -42,68 +42,311 @@
 package rcache
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"github.com/garyburd/redigo/redis"
+	"github.com/greivinlopez/skue"
 	"os"
+	"sync"
 	"time"
 )
 
+// NoExpiration is the TTL of the values that never expire.
+const NoExpiration time.Duration = -1
+
+// Options sets how a RedisCacher connects to its Redis server and how long
+// the values are cached. Zero values take the defaults.
+type Options struct {
+	Address  string // Address of the Redis server, "127.0.0.1:6379" by default
+	Password string // Password for the AUTH command, $RCACHE_REDIS_PASS by default
+	NoAuth   bool   // Never send the AUTH command, even if $RCACHE_REDIS_PASS is set
+	DB       int    // Database selected after connecting
+
+	MaxIdle     int           // Maximum idle connections in the pool, 3 by default
+	MaxActive   int           // Maximum connections in the pool, no limit by default
+	IdleTimeout time.Duration // Idle connections are closed after it, 240 seconds by default
+	Wait        bool          // Wait for a free connection when MaxActive is reached
+
+	DialTimeout  time.Duration // Timeout for connecting to the server
+	ReadTimeout  time.Duration // Timeout for reading each reply
+	WriteTimeout time.Duration // Timeout for writing each command
+
+	// TTL is the time to live of the cached values, 120 seconds by default.
+	// Use NoExpiration for values that must be kept until deleted.
+	TTL time.Duration
+	// KeyTTL, if not nil, gives the time to live for each key. Returning 0
+	// uses TTL.
+	KeyTTL func(key interface{}) time.Duration
+
+	// Codec encodes the cached values, skue.JSONCodec by default. Values
+	// cached with another codec are reported as misses.
+	Codec skue.Codec
+	// CompressionMinSize is the minimum size in bytes of the values to be
+	// compressed. Zero means no compression.
+	CompressionMinSize int
+}
+
 // The RedisCacher is an implementation of the MemoryCacher interface.
 // See more about MemoryCacher here:
 //   https://github.com/greivinlopez/skue
 // It is a memory caching system based on Redis:
 //   http://redis.io/
+// Each cacher owns its pool of connections, so several Redis servers can be
+// used in the same process. The zero value is a cacher for the default Redis
+// server.
 type RedisCacher struct {
+	options Options
+	pool    *redis.Pool
+	once    sync.Once
+
+	// config holds the options with the defaults applied. It is written
+	// once when the pool is created and must only be read after dial.
+	config Options
 }
 
+// The errors of the cacher are classified as one of these, so callers can
+// check them with errors.Is and tell a missing key from a Redis server that
+// is not working.
 var (
-	redisPool     *redis.Pool
-	redisServer   = "127.0.0.1:6379"
-	redisPassword = ""
+	// ErrMiss means the key is not cached. It is skue.ErrCacheMiss.
+	ErrMiss = skue.ErrCacheMiss
+	// ErrConnection means Redis could not be used: it could not be reached,
+	// it timed out or it rejected the command. These errors also match
+	// skue.ErrUnavailable.
+	ErrConnection = errors.New("rcache: connection failure")
+	// ErrSerialization means the value could not be encoded or decoded.
+	ErrSerialization = errors.New("rcache: serialization failure")
 )
-var ErrCantConnect = errors.New("Can't connect to redis")
 
-// New creates a new RedisCacher.
-func New() *RedisCacher {
-	return &RedisCacher{}
+// ErrCantConnect is kept for compatibility, it is ErrConnection.
+var ErrCantConnect = ErrConnection
+
+// cacheError is an error of the cacher classified as one of the errors
+// above. Both errors can be checked with errors.Is.
+type cacheError struct {
+	kind error
+	err  error
+}
+
+func (e *cacheError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
 }
 
-// dial establishes a new Redis connection object and creates
-// the connection pool if needed. The password for Redis auth
-// is fetched from an environment variable following this:
+func (e *cacheError) Unwrap() []error {
+	if e.kind == ErrConnection {
+		return []error{e.kind, skue.ErrUnavailable, e.err}
+	}
+	return []error{e.kind, e.err}
+}
+
+// classify wraps the errors of Redis with the error that describes them.
+// The errors of the context are returned as they are, the client went away
+// or ran out of time but Redis is working.
+func classify(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == redis.ErrNil:
+		return ErrMiss
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return err
+	}
+	var classified *cacheError
+	if errors.As(err, &classified) {
+		return err
+	}
+	return &cacheError{ErrConnection, err}
+}
+
+// New creates a new RedisCacher for the Redis server running on
+// 127.0.0.1:6379. The password for Redis auth is fetched from an
+// environment variable following this:
 //
 //    http://12factor.net/config
 //
-func (cacher *RedisCacher) dial() (redis.Conn, error) {
-	if redisPool == nil {
-		// Retrieve the password from OS environment.
-		redisPassword = os.Getenv("RCACHE_REDIS_PASS")
-		redisPool = &redis.Pool{
-			MaxIdle:     3,
-			IdleTimeout: 240 * time.Second,
-			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", redisServer)
-				if err != nil {
-					return nil, err
-				}
-				if _, err := c.Do("AUTH", redisPassword); err != nil {
+func New() *RedisCacher {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a new RedisCacher with the given options.
+func NewWithOptions(options Options) *RedisCacher {
+	return &RedisCacher{options: options}
+}
+
+// withDefaults returns the options with the defaults for the zero values.
+func (options Options) withDefaults() Options {
+	if options.Address == "" {
+		options.Address = "127.0.0.1:6379"
+	}
+	if options.NoAuth {
+		options.Password = ""
+	} else if options.Password == "" {
+		options.Password = os.Getenv("RCACHE_REDIS_PASS")
+	}
+	if options.MaxIdle == 0 {
+		options.MaxIdle = 3
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = 240 * time.Second
+	}
+	if options.TTL == 0 {
+		options.TTL = 120 * time.Second
+	}
+	return options
+}
+
+// createPool creates the connection pool of the cacher.
+func (cacher *RedisCacher) createPool() {
+	cacher.config = cacher.options.withDefaults()
+	options := cacher.config
+	cacher.pool = &redis.Pool{
+		MaxIdle:     options.MaxIdle,
+		MaxActive:   options.MaxActive,
+		IdleTimeout: options.IdleTimeout,
+		Wait:        options.Wait,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", options.Address,
+				redis.DialDatabase(options.DB),
+				redis.DialConnectTimeout(options.DialTimeout),
+				redis.DialReadTimeout(options.ReadTimeout),
+				redis.DialWriteTimeout(options.WriteTimeout))
+			if err != nil {
+				return nil, err
+			}
+			if options.Password != "" {
+				if _, err := c.Do("AUTH", options.Password); err != nil {
 					c.Close()
 					return nil, err
 				}
-				return c, err
-			},
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, err := c.Do("PING")
-				return err
-			},
+			}
+			return c, nil
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// dial gets a Redis connection from the pool of the cacher, creating the
+// pool if needed. The errors connecting to Redis are returned by the pooled
+// connection, see redis.Pool.Get.
+func (cacher *RedisCacher) dial() (redis.Conn, error) {
+	cacher.once.Do(cacher.createPool)
+	c := cacher.pool.Get()
+	return c, c.Err()
+}
+
+// Ping checks that the Redis server of the cacher can be used, returning an
+// error matching ErrConnection when it can not.
+func (cacher *RedisCacher) Ping(ctx context.Context) error {
+	c, err := cacher.dial()
+	if err != nil {
+		return classify(err)
+	}
+	defer c.Close()
+
+	_, err = do(ctx, c, "PING")
+	return classify(err)
+}
+
+// Close closes the connections of the cacher. The cacher can not be used
+// after it is closed.
+func (cacher *RedisCacher) Close() error {
+	// The pool is created if needed so Close does not race with dial
+	cacher.once.Do(cacher.createPool)
+	return cacher.pool.Close()
+}
+
+// encoding returns the encoding of the values of the cacher.
+func (cacher *RedisCacher) encoding() skue.ValueEncoding {
+	return skue.ValueEncoding{
+		Codec:              cacher.options.Codec,
+		CompressionMinSize: cacher.options.CompressionMinSize,
+	}
+}
+
+// decode decodes a cached value into the given pointer.
+func (cacher *RedisCacher) decode(data []byte, entityPointer interface{}) error {
+	err := cacher.encoding().Decode(data, entityPointer)
+	if err == skue.ErrCodecMismatch {
+		return &cacheError{ErrMiss, err}
+	} else if err != nil {
+		return &cacheError{ErrSerialization, err}
+	}
+	return nil
+}
+
+// ttl returns the time to live of the given key. It must be called after
+// dial.
+func (cacher *RedisCacher) ttl(key interface{}) time.Duration {
+	if cacher.config.KeyTTL != nil {
+		if ttl := cacher.config.KeyTTL(key); ttl != 0 {
+			return ttl
+		}
+	}
+	return cacher.config.TTL
+}
+
+// SetWithTTL caches the value for the given time to live instead of the one
+// given by the options. A ttl of 0 uses the options, NoExpiration keeps the
+// value until it is deleted.
+func (cacher *RedisCacher) SetWithTTL(key interface{}, value interface{}, ttl time.Duration) error {
+	return cacher.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// SetWithTTLContext caches the value like SetWithTTL, giving up when the
+// context is done.
+func (cacher *RedisCacher) SetWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error {
+	data, err := cacher.encoding().Encode(value)
+	if err != nil {
+		return &cacheError{ErrSerialization, err}
+	}
+
+	c, err := cacher.dial()
+	if err != nil {
+		return classify(err)
+	}
+	defer c.Close()
+
+	if ttl == 0 {
+		ttl = cacher.ttl(key)
+	}
+	if ttl > 0 {
+		// Redis expects at least one millisecond
+		milliseconds := int64(ttl / time.Millisecond)
+		if milliseconds == 0 {
+			milliseconds = 1
 		}
+		_, err = do(ctx, c, "SET", key, data, "PX", milliseconds)
+	} else {
+		_, err = do(ctx, c, "SET", key, data)
+	}
+	return classify(err)
+}
+
+// do sends a command to Redis through the given connection. The command
+// fails if the context is done before sending it, and it times out at the
+// deadline of the context if any.
+func do(ctx context.Context, c redis.Conn, command string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return c.Do(command, args...)
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
 	}
-	if redisPool != nil {
-		conn := redisPool.Get()
-		return conn, nil
+	reply, err := redis.DoWithTimeout(c, timeout, command, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
-	return nil, ErrCantConnect
+	return reply, err
 }
 
 // ----------------------------------------------------------------------------
@@ -111,46 +354,132 @@ func (cacher *RedisCacher) dial() (redis.Conn, error) {
 // ----------------------------------------------------------------------------
 
 func (cacher *RedisCacher) Set(key interface{}, value interface{}) error {
+	return cacher.SetContext(context.Background(), key, value)
+}
+
+// Get decodes the cached value into the given pointer. Returns ErrMiss if
+// the key is not cached or it was cached with another codec.
+func (cacher *RedisCacher) Get(key interface{}, entityPointer interface{}) error {
+	return cacher.GetContext(context.Background(), key, entityPointer)
+}
+
+func (cacher *RedisCacher) Delete(key interface{}) error {
+	return cacher.DeleteContext(context.Background(), key)
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.ContextMemoryCacher implementation
+// ----------------------------------------------------------------------------
+
+func (cacher *RedisCacher) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	return cacher.SetWithTTLContext(ctx, key, value, 0)
+}
+
+func (cacher *RedisCacher) GetContext(ctx context.Context, key interface{}, entityPointer interface{}) error {
 	c, err := cacher.dial()
 	if err != nil {
-		return err
+		return classify(err)
 	}
 	defer c.Close()
 
-	jsonvalue, err := json.MarshalIndent(value, " ", " ")
+	data, err := redis.Bytes(do(ctx, c, "GET", key))
 	if err != nil {
-		return err
+		return classify(err)
 	}
 
-	c.Do("SET", key, jsonvalue, "EX", 120)
-	return nil
+	return cacher.decode(data, entityPointer)
 }
 
-func (cacher *RedisCacher) Get(key interface{}, entityPointer interface{}) error {
+func (cacher *RedisCacher) DeleteContext(ctx context.Context, key interface{}) error {
 	c, err := cacher.dial()
 	if err != nil {
-		return err
+		return classify(err)
 	}
 	defer c.Close()
 
-	jsonvalue, err := redis.String(c.Do("GET", key))
+	_, err = do(ctx, c, "DEL", key)
+	return classify(err)
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.ExpiringCacher and skue.Locker implementation
+// ----------------------------------------------------------------------------
+
+// GetWithTTLContext decodes the cached value into the given pointer and
+// returns the time it remains cached, negative if it never expires.
+func (cacher *RedisCacher) GetWithTTLContext(ctx context.Context, key interface{}, entityPointer interface{}) (time.Duration, error) {
+	c, err := cacher.dial()
 	if err != nil {
-		return err
+		return 0, classify(err)
 	}
+	defer c.Close()
 
-	err = json.Unmarshal([]byte(jsonvalue), entityPointer)
-	return err
+	c.Send("MULTI")
+	c.Send("GET", key)
+	c.Send("PTTL", key)
+	values, err := redis.Values(do(ctx, c, "EXEC"))
+	if err != nil {
+		return 0, classify(err)
+	}
+	data, err := redis.Bytes(values[0], nil)
+	if err != nil {
+		return 0, classify(err)
+	}
+	milliseconds, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return 0, classify(err)
+	}
+	if err = cacher.decode(data, entityPointer); err != nil {
+		return 0, err
+	}
+	if milliseconds < 0 {
+		return NoExpiration, nil
+	}
+	return time.Duration(milliseconds) * time.Millisecond, nil
 }
 
-func (cacher *RedisCacher) Delete(key interface{}) error {
+// Releases the lock only if it is still held with the same token, it could
+// have expired and been taken by someone else
+var unlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Lock acquires the lock of the key for the given time to live, returning
+// skue.ErrLocked if it is held by someone else. The lock is shared by all
+// the clients of the Redis server.
+func (cacher *RedisCacher) Lock(ctx context.Context, key string, ttl time.Duration) (unlock func() error, err error) {
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(random)
+	milliseconds := int64(ttl / time.Millisecond)
+	if milliseconds == 0 {
+		milliseconds = 1
+	}
+
 	c, err := cacher.dial()
 	if err != nil {
-		return err
+		return nil, classify(err)
 	}
 	defer c.Close()
 
-	c.Do("DEL", key)
-	return nil
+	_, err = redis.String(do(ctx, c, "SET", key, token, "NX", "PX", milliseconds))
+	if err == redis.ErrNil {
+		return nil, skue.ErrLocked
+	} else if err != nil {
+		return nil, classify(err)
+	}
+	unlock = func() error {
+		c, err := cacher.dial()
+		if err != nil {
+			return classify(err)
+		}
+		defer c.Close()
+		_, err = unlockScript.Do(c, key, token)
+		return classify(err)
+	}
+	return unlock, nil
 }
-
-// ----------------------------------------------------------------------------
@@ -0,0 +1,266 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package rcache
+
+import (
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"github.com/greivinlopez/skue"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is a connection to a fake Redis server keeping the values in
+// memory. Every command fails with err when it is not nil.
+type fakeConn struct {
+	mutex  sync.Mutex
+	values map[string][]byte
+	ttls   map[string]int64
+	err    error
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{values: map[string][]byte{}, ttls: map[string]int64{}}
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Err() error {
+	return nil
+}
+
+func (c *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if command == "" {
+		return nil, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	key, _ := args[0].(string)
+	switch command {
+	case "GET":
+		if value, found := c.values[key]; found {
+			return value, nil
+		}
+		return nil, nil
+	case "SET":
+		c.values[key] = args[1].([]byte)
+		c.ttls[key] = -1
+		if len(args) == 4 && args[2] == "PX" {
+			c.ttls[key] = args[3].(int64)
+		}
+		return "OK", nil
+	case "DEL":
+		delete(c.values, key)
+		return int64(1), nil
+	}
+	return nil, redis.Error("ERR unknown command '" + command + "'")
+}
+
+func (c *fakeConn) Send(command string, args ...interface{}) error {
+	return nil
+}
+
+func (c *fakeConn) Flush() error {
+	return nil
+}
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	return nil, nil
+}
+
+// newFakeCacher returns a cacher whose connections are the given one, or
+// fail to connect with dialErr.
+func newFakeCacher(c *fakeConn, dialErr error, options Options) *RedisCacher {
+	cacher := NewWithOptions(options)
+	cacher.once.Do(func() {
+		cacher.config = options.withDefaults()
+		cacher.pool = &redis.Pool{Dial: func() (redis.Conn, error) {
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			return c, nil
+		}}
+	})
+	return cacher
+}
+
+func TestClassify(t *testing.T) {
+	classified := &cacheError{ErrSerialization, errors.New("bad value")}
+	tests := []struct {
+		name string
+		err  error
+		want []error
+	}{
+		{"miss", redis.ErrNil, []error{ErrMiss, skue.ErrCacheMiss}},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, []error{ErrConnection, skue.ErrUnavailable}},
+		{"reply", redis.Error("READONLY You can't write against a read only replica"), []error{ErrConnection, skue.ErrUnavailable}},
+		{"canceled", context.Canceled, []error{context.Canceled}},
+		{"deadline", context.DeadlineExceeded, []error{context.DeadlineExceeded}},
+		{"classified", classified, []error{ErrSerialization}},
+	}
+	for _, test := range tests {
+		err := classify(test.err)
+		for _, want := range test.want {
+			if !errors.Is(err, want) {
+				t.Errorf("%s: got %v, want it to match %v", test.name, err, want)
+			}
+		}
+		if test.err == context.Canceled || test.err == context.DeadlineExceeded {
+			if err != test.err {
+				t.Errorf("%s: got %v, want it unwrapped", test.name, err)
+			}
+		}
+	}
+	if classify(nil) != nil {
+		t.Errorf("got an error for nil")
+	}
+}
+
+func TestRedisCacher(t *testing.T) {
+	c := newFakeConn()
+	cacher := newFakeCacher(c, nil, Options{})
+	if err := cacher.Set("team-1", team{Name: "Saprissa"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got := team{}
+	if err := cacher.Get("team-1", &got); err != nil || got.Name != "Saprissa" {
+		t.Errorf("got %+v, %v, want Saprissa", got, err)
+	}
+	if err := cacher.Delete("team-1"); err != nil {
+		t.Errorf("unexpected error %v deleting", err)
+	}
+	if err := cacher.Get("team-1", &got); !errors.Is(err, ErrMiss) {
+		t.Errorf("got %v after deleting, want %v", err, ErrMiss)
+	}
+}
+
+func TestRedisCacherCodecMismatch(t *testing.T) {
+	c := newFakeConn()
+	newFakeCacher(c, nil, Options{Codec: skue.GobCodec}).Set("team-1", team{Name: "Saprissa"})
+	got := team{}
+	err := newFakeCacher(c, nil, Options{}).Get("team-1", &got)
+	if !errors.Is(err, ErrMiss) || !errors.Is(err, skue.ErrCodecMismatch) {
+		t.Errorf("got %v, want a miss for the value of another codec", err)
+	}
+}
+
+func TestRedisCacherErrors(t *testing.T) {
+	failing := newFakeConn()
+	failing.err = redis.Error("READONLY You can't write against a read only replica")
+	tests := []struct {
+		name   string
+		cacher *RedisCacher
+	}{
+		{"reply", newFakeCacher(failing, nil, Options{})},
+		{"dial", newFakeCacher(nil, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, Options{})},
+	}
+	for _, test := range tests {
+		if err := test.cacher.Set("team-1", team{Name: "Saprissa"}); !errors.Is(err, ErrConnection) || !errors.Is(err, skue.ErrUnavailable) {
+			t.Errorf("%s: got %v setting, want %v", test.name, err, ErrConnection)
+		}
+		if err := test.cacher.Delete("team-1"); !errors.Is(err, ErrConnection) {
+			t.Errorf("%s: got %v deleting, want %v", test.name, err, ErrConnection)
+		}
+		if err := test.cacher.Get("team-1", &team{}); !errors.Is(err, ErrConnection) {
+			t.Errorf("%s: got %v getting, want %v", test.name, err, ErrConnection)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newFakeCacher(newFakeConn(), nil, Options{}).SetContext(ctx, "team-1", team{}); err != context.Canceled {
+		t.Errorf("got %v with a canceled context, want %v", err, context.Canceled)
+	}
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	t.Setenv("RCACHE_REDIS_PASS", "secret")
+	tests := []struct {
+		name     string
+		options  Options
+		password string
+	}{
+		{"defaults", Options{}, "secret"},
+		{"password", Options{Password: "other"}, "other"},
+		{"no auth", Options{NoAuth: true}, ""},
+		{"no auth with password", Options{Password: "other", NoAuth: true}, ""},
+	}
+	for _, test := range tests {
+		options := test.options.withDefaults()
+		if options.Password != test.password {
+			t.Errorf("%s: got password %q, want %q", test.name, options.Password, test.password)
+		}
+		if options.Address != "127.0.0.1:6379" || options.MaxIdle != 3 || options.IdleTimeout != 240*time.Second || options.TTL != 120*time.Second {
+			t.Errorf("%s: got %+v, want the defaults", test.name, options)
+		}
+	}
+	options := Options{Address: "redis:6380", MaxIdle: 10, IdleTimeout: time.Minute, TTL: time.Hour}.withDefaults()
+	if options.Address != "redis:6380" || options.MaxIdle != 10 || options.IdleTimeout != time.Minute || options.TTL != time.Hour {
+		t.Errorf("got %+v, want the given options", options)
+	}
+}
+
+func TestRedisCacherTTL(t *testing.T) {
+	c := newFakeConn()
+	cacher := newFakeCacher(c, nil, Options{
+		TTL: time.Minute,
+		KeyTTL: func(key interface{}) time.Duration {
+			switch key {
+			case "team-hot":
+				return time.Second
+			case "team-forever":
+				return NoExpiration
+			}
+			return 0
+		},
+	})
+	forever := newFakeCacher(c, nil, Options{TTL: NoExpiration})
+	tests := []struct {
+		name   string
+		cacher *RedisCacher
+		key    string
+		ttl    time.Duration
+		want   int64
+	}{
+		{"options", cacher, "team-1", 0, 60000},
+		{"key", cacher, "team-hot", 0, 1000},
+		{"key never expires", cacher, "team-forever", 0, -1},
+		{"given", cacher, "team-hot", 5 * time.Second, 5000},
+		{"given never expires", cacher, "team-1", NoExpiration, -1},
+		{"less than a millisecond", cacher, "team-1", time.Microsecond, 1},
+		{"options never expire", forever, "team-1", 0, -1},
+	}
+	for _, test := range tests {
+		if err := test.cacher.SetWithTTL(test.key, team{Name: "Saprissa"}, test.ttl); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if got := c.ttls[test.key]; got != test.want {
+			t.Errorf("%s: got a ttl of %dms, want %dms", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+)
+
+// ----------------------------------------------------------------------------
+// CODECS
+//
+// The MemoryCachers store the values encoded. The first byte of an encoded
+// value tells the codec that encoded it and whether it was compressed, so the
+// codec of a cache can be changed without decoding the values cached before
+// with the wrong codec.
+
+// Codec encodes and decodes the values stored by a MemoryCacher.
+type Codec interface {
+	// Version identifies the codec and the format of its values. It is stored
+	// with each value and it must be between 1 and 127. The versions up to 15
+	// are reserved for the codecs of skue.
+	Version() byte
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var (
+	// JSONCodec encodes the values as compact JSON.
+	JSONCodec Codec = jsonCodec{}
+	// GobCodec encodes the values with encoding/gob, which keeps the exact
+	// types of the fields. Values stored in interfaces must be registered
+	// with gob.Register.
+	GobCodec Codec = gobCodec{}
+)
+
+// ErrCodecMismatch is returned when decoding a value encoded by another codec
+// or version. The MemoryCachers report it as a cache miss, so the value is
+// cached again with the current codec.
+var ErrCodecMismatch = errors.New("codec mismatch")
+
+// Flag of the first byte for the compressed values
+const compressedFlag = 0x80
+
+// ValueEncoding encodes the values of a MemoryCacher with a codec, adding the
+// version byte and compressing the large values. The zero value encodes with
+// JSONCodec and never compresses.
+type ValueEncoding struct {
+	Codec Codec // JSONCodec if nil
+	// CompressionMinSize is the minimum size in bytes of the values to be
+	// compressed with gzip. Zero means no compression.
+	CompressionMinSize int
+}
+
+// codec returns the codec of the encoding.
+func (encoding ValueEncoding) codec() Codec {
+	if encoding.Codec == nil {
+		return JSONCodec
+	}
+	return encoding.Codec
+}
+
+// Encode encodes the given value.
+func (encoding ValueEncoding) Encode(value interface{}) ([]byte, error) {
+	codec := encoding.codec()
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	version := codec.Version()
+	if encoding.CompressionMinSize > 0 && len(data) >= encoding.CompressionMinSize {
+		var buffer bytes.Buffer
+		buffer.WriteByte(version | compressedFlag)
+		writer := gzip.NewWriter(&buffer)
+		if _, err = writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err = writer.Close(); err != nil {
+			return nil, err
+		}
+		// Compressing is not worth it if the value does not get smaller
+		if buffer.Len() <= len(data) {
+			return buffer.Bytes(), nil
+		}
+	}
+	return append([]byte{version}, data...), nil
+}
+
+// Decode decodes the given encoded value into the value pointer. It returns
+// ErrCodecMismatch if the value was not encoded by the codec of the encoding.
+func (encoding ValueEncoding) Decode(data []byte, value interface{}) error {
+	codec := encoding.codec()
+	if len(data) == 0 || data[0]&^compressedFlag != codec.Version() {
+		return ErrCodecMismatch
+	}
+	if data[0]&compressedFlag != 0 {
+		reader, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		uncompressed, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		return codec.Unmarshal(uncompressed, value)
+	}
+	return codec.Unmarshal(data[1:], value)
+}
+
+// ----------------------------------------------------------------------------
+// 			Built in codecs
+// ----------------------------------------------------------------------------
+
+type jsonCodec struct{}
+
+func (jsonCodec) Version() byte {
+	return 1
+}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Version() byte {
+	return 2
+}
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
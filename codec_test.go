@@ -0,0 +1,103 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type codecValue struct {
+	Name    string
+	Number  int
+	Country string
+}
+
+func TestValueEncoding(t *testing.T) {
+	value := codecValue{Name: "Keylor", Number: 1, Country: strings.Repeat("Costa Rica ", 20)}
+	tests := []struct {
+		name       string
+		encoding   ValueEncoding
+		version    byte
+		compressed bool
+	}{
+		{"json by default", ValueEncoding{}, 1, false},
+		{"json", ValueEncoding{Codec: JSONCodec}, 1, false},
+		{"gob", ValueEncoding{Codec: GobCodec}, 2, false},
+		{"json compressed", ValueEncoding{Codec: JSONCodec, CompressionMinSize: 64}, 1, true},
+		{"gob compressed", ValueEncoding{Codec: GobCodec, CompressionMinSize: 64}, 2, true},
+		{"below the threshold", ValueEncoding{Codec: JSONCodec, CompressionMinSize: 1 << 20}, 1, false},
+	}
+	for _, test := range tests {
+		data, err := test.encoding.Encode(value)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if version := data[0] &^ compressedFlag; version != test.version {
+			t.Errorf("%s: got version %d, want %d", test.name, version, test.version)
+		}
+		if compressed := data[0]&compressedFlag != 0; compressed != test.compressed {
+			t.Errorf("%s: got compressed %v, want %v", test.name, compressed, test.compressed)
+		}
+		decoded := codecValue{}
+		if err = test.encoding.Decode(data, &decoded); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("%s: got %+v, want %+v", test.name, decoded, value)
+		}
+	}
+}
+
+func TestValueEncodingIncompressible(t *testing.T) {
+	// Values that do not get smaller are stored uncompressed
+	encoding := ValueEncoding{CompressionMinSize: 1}
+	data, err := encoding.Encode(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0]&compressedFlag != 0 {
+		t.Errorf("got %v compressed, want it stored as it is", data)
+	}
+}
+
+func TestValueEncodingMismatch(t *testing.T) {
+	jsonEncoding := ValueEncoding{Codec: JSONCodec}
+	gobEncoding := ValueEncoding{Codec: GobCodec, CompressionMinSize: 1}
+	data, err := gobEncoding.Encode(codecValue{Name: strings.Repeat("Keylor", 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"other codec", data},
+		{"empty", nil},
+		{"no version byte", []byte(`{"Name":"Keylor"}`)},
+	}
+	for _, test := range tests {
+		if err := jsonEncoding.Decode(test.data, &codecValue{}); err != ErrCodecMismatch {
+			t.Errorf("%s: got %v, want ErrCodecMismatch", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// COMPRESSION
+//
+// Content codings as described by RFC 7231 sections 3.1.2.2 and 5.3.4
+
+var (
+	// Compression enables the compression of the responses written by the
+	// producers, using the content coding negotiated with the client
+	// through the Accept-Encoding header. It is disabled by default, so the
+	// responses are sent as they are.
+	Compression = false
+	// CompressionMinSize is the minimum size in bytes of the bodies to be
+	// compressed, compressing tiny bodies is not worth it.
+	CompressionMinSize = 1024
+	// MaxBodySize is the maximum size in bytes of the request bodies once
+	// decompressed. Larger bodies are answered with "413 Request Entity Too
+	// Large". Zero means no limit, but compressed bodies are still limited
+	// to MaxDecompressedBodySize bytes.
+	MaxBodySize int64 = 0
+	// MaxDecompressedBodySize is the maximum size in bytes of the compressed
+	// request bodies once decompressed when MaxBodySize is zero, so a tiny
+	// compressed body can not exhaust the memory of the server.
+	MaxDecompressedBodySize int64 = 10 << 20
+)
+
+// Supported content codings in order of preference
+var encodings = []string{"gzip", "deflate"}
+
+// negotiateEncoding returns the content coding, from the supported ones,
+// with the highest quality value in the given Accept-Encoding header field
+// value, or "" if none of them is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, element := range splitHeader(acceptEncoding) {
+		parts := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(parts[0]))
+		quality := 1.0
+		for _, param := range parts[1:] {
+			pair := strings.SplitN(param, "=", 2)
+			if len(pair) == 2 && strings.EqualFold(strings.TrimSpace(pair[0]), "q") {
+				if q, ok := parseQuality(pair[1]); ok {
+					quality = q
+				}
+			}
+		}
+		qualities[coding] = quality
+	}
+	best, bestQuality := "", 0.0
+	for _, coding := range encodings {
+		quality, found := qualities[coding]
+		if !found {
+			quality, found = qualities["*"]
+		}
+		if found && quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// compressWriter is an http writer that buffers the response to compress it
+// when the body is big enough.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int
+	wroteHeader bool
+	buffer      bytes.Buffer
+}
+
+// newCompressWriter returns a compressWriter for the encoding negotiated
+// with the client or nil if the response must not be compressed.
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	if !Compression {
+		return nil
+	}
+	AddVary(w.Header(), HEADER_AcceptEncoding)
+	encoding := negotiateEncoding(r.Header.Get(HEADER_AcceptEncoding))
+	if encoding == "" || w.Header().Get(HEADER_ContentEncoding) != "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.buffer.Write(data)
+}
+
+// Close writes the buffered response, compressed if it is worth it. The
+// response is written as it is when it can not be compressed, and the error
+// of the compression is returned.
+func (w *compressWriter) Close() error {
+	if !w.wroteHeader {
+		return nil
+	}
+	body := w.buffer.Bytes()
+	if len(body) < CompressionMinSize || w.status == http.StatusNoContent || w.status == http.StatusNotModified {
+		w.ResponseWriter.WriteHeader(w.status)
+		_, err := w.ResponseWriter.Write(body)
+		return err
+	}
+	compressed := bytes.Buffer{}
+	var encoder io.WriteCloser
+	if w.encoding == "gzip" {
+		encoder = gzip.NewWriter(&compressed)
+	} else {
+		encoder = zlib.NewWriter(&compressed)
+	}
+	_, err := encoder.Write(body)
+	if closeErr := encoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(body)
+		return err
+	}
+	w.Header().Set(HEADER_ContentEncoding, w.encoding)
+	w.Header().Del(HEADER_ContentLength)
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err = w.ResponseWriter.Write(compressed.Bytes())
+	return err
+}
+
+// out writes the value with the producer compressing the output when the
+// client accepts it. The errors writing the compressed output are logged to
+// ErrorLog, unless the client went away.
+func out(producer Producer, w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	compressor := newCompressWriter(w, r)
+	if compressor == nil {
+		producer.Out(w, status, value)
+		return
+	}
+	producer.Out(compressor, status, value)
+	if err := compressor.Close(); err != nil && !clientGone(r, err) {
+		logf(nil, "skue: writing the %s response: %v", compressor.encoding, err)
+	}
+}
+
+// decompressBody replaces the body of the request with its decoded content
+// when the request has a gzip or deflate Content-Encoding. Other content
+// codings are reported with ErrUnsupportedMediaType. Reading more than
+// MaxBodySize bytes from the body, or MaxDecompressedBodySize bytes from a
+// compressed body when it is zero, fails with an *http.MaxBytesError.
+func decompressBody(r *http.Request) error {
+	var err error
+	var body io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get(HEADER_ContentEncoding))) {
+	case "", "identity":
+		limitBody(r, MaxBodySize)
+		return nil
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(r.Body)
+	case "deflate":
+		body, err = zlib.NewReader(r.Body)
+	default:
+		return ErrUnsupportedMediaType
+	}
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(body)
+	r.Header.Del(HEADER_ContentEncoding)
+	r.ContentLength = -1
+	if MaxBodySize > 0 {
+		limitBody(r, MaxBodySize)
+	} else {
+		limitBody(r, MaxDecompressedBodySize)
+	}
+	return nil
+}
+
+// limitBody limits the body of the request to the given size in bytes, zero
+// means no limit.
+func limitBody(r *http.Request, size int64) {
+	if size > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, size)
+	}
+}
@@ -0,0 +1,180 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// brokenWriter is an http writer whose writes fail.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestCompressionErrorLog(t *testing.T) {
+	logged := &bytes.Buffer{}
+	ErrorLog = log.New(logged, "", 0)
+	Compression = true
+	defer func() { ErrorLog, Compression = nil, false }()
+
+	r := httptest.NewRequest("GET", "/players/1", nil)
+	r.Header.Set(HEADER_AcceptEncoding, "gzip")
+	w := brokenWriter{httptest.NewRecorder()}
+	Produce(testProducer(MIME_JSON), w, r, http.StatusOK, strings.Repeat("Keylor ", CompressionMinSize))
+	if !strings.Contains(logged.String(), "connection reset by peer") {
+		t.Errorf("got %q logged, want the write error", logged)
+	}
+	if w.Header().Get(HEADER_ContentEncoding) != "gzip" {
+		t.Errorf("got Content-Encoding %q, want gzip", w.Header().Get(HEADER_ContentEncoding))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	Compression = true
+	defer func() { Compression = false }()
+	large := strings.Repeat("Keylor ", CompressionMinSize)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		value          string
+		want           string
+	}{
+		{"gzip", "gzip", large, "gzip"},
+		{"deflate", "deflate", large, "deflate"},
+		{"preferred", "gzip;q=0.5, deflate", large, "deflate"},
+		{"any", "*", large, "gzip"},
+		{"refused", "gzip;q=0", large, ""},
+		{"refused any", "*;q=0", large, ""},
+		{"unsupported", "br", large, ""},
+		{"none", "", large, ""},
+		{"too small", "gzip", "Keylor", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/players/1", nil)
+		r.Header.Set(HEADER_AcceptEncoding, test.acceptEncoding)
+		w := httptest.NewRecorder()
+		Produce(testProducer(MIME_JSON), w, r, http.StatusOK, test.value)
+		if got := w.Header().Get(HEADER_ContentEncoding); got != test.want {
+			t.Errorf("%s: got Content-Encoding %q, want %q", test.name, got, test.want)
+			continue
+		}
+		if vary := strings.Join(w.Header().Values(HEADER_Vary), ", "); !strings.Contains(vary, HEADER_AcceptEncoding) {
+			t.Errorf("%s: got Vary %q, want it to contain %s", test.name, vary, HEADER_AcceptEncoding)
+		}
+		var body io.Reader = w.Body
+		var err error
+		switch test.want {
+		case "gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = zlib.NewReader(body)
+		}
+		var got string
+		if err == nil {
+			err = json.NewDecoder(body).Decode(&got)
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if got != test.value {
+			t.Errorf("%s: got %d bytes, want %d", test.name, len(got), len(test.value))
+		}
+	}
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	r := httptest.NewRequest("GET", "/players/1", nil)
+	r.Header.Set(HEADER_AcceptEncoding, "gzip")
+	w := httptest.NewRecorder()
+	Produce(testProducer(MIME_JSON), w, r, http.StatusOK, strings.Repeat("Keylor ", CompressionMinSize))
+	if got := w.Header().Get(HEADER_ContentEncoding); got != "" {
+		t.Errorf("got Content-Encoding %q, want none", got)
+	}
+}
+
+// compress returns the data compressed with the given content coding.
+func compress(encoding string, data string) *bytes.Buffer {
+	compressed := &bytes.Buffer{}
+	var encoder io.WriteCloser = gzip.NewWriter(compressed)
+	if encoding == "deflate" {
+		encoder = zlib.NewWriter(compressed)
+	}
+	encoder.Write([]byte(data))
+	encoder.Close()
+	return compressed
+}
+
+func TestDecompressBody(t *testing.T) {
+	defer func(size int64) { MaxDecompressedBodySize = size }(MaxDecompressedBodySize)
+	MaxDecompressedBodySize = 64
+	large := `"` + strings.Repeat("Keylor ", 10) + `"`
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            io.Reader
+		maxBodySize     int64
+		want            string
+		err             error
+	}{
+		{"plain", "", strings.NewReader(`"Keylor"`), 0, "Keylor", nil},
+		{"gzip", "gzip", compress("gzip", `"Keylor"`), 0, "Keylor", nil},
+		{"x-gzip", "x-gzip", compress("gzip", `"Keylor"`), 0, "Keylor", nil},
+		{"deflate", "deflate", compress("deflate", `"Keylor"`), 0, "Keylor", nil},
+		{"unsupported", "br", strings.NewReader(`"Keylor"`), 0, "", ErrUnsupportedMediaType},
+		{"plain unlimited", "", strings.NewReader(large), 0, strings.Trim(large, `"`), nil},
+		{"plain too large", "", strings.NewReader(large), 16, "", &http.MaxBytesError{}},
+		{"gzip too large", "gzip", compress("gzip", large), 0, "", &http.MaxBytesError{}},
+		{"gzip within MaxBodySize", "gzip", compress("gzip", large), 1024, strings.Trim(large, `"`), nil},
+	}
+	for _, test := range tests {
+		MaxBodySize = test.maxBodySize
+		r := httptest.NewRequest("POST", "/players", test.body)
+		r.Header.Set(HEADER_ContentType, MIME_JSON)
+		r.Header.Set(HEADER_ContentEncoding, test.contentEncoding)
+		var got string
+		err := consume(testConsumer(MIME_JSON), r, &got)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case test.err == nil && got != test.want:
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		case test.err == ErrUnsupportedMediaType && err != ErrUnsupportedMediaType:
+			t.Errorf("%s: got error %v, want %v", test.name, err, ErrUnsupportedMediaType)
+		case test.err != nil && test.err != ErrUnsupportedMediaType && !errors.As(err, &tooLarge):
+			t.Errorf("%s: got error %v, want an *http.MaxBytesError", test.name, err)
+		}
+	}
+	MaxBodySize = 0
+}
@@ -0,0 +1,228 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// CONDITIONAL REQUESTS
+//
+// Conditional requests as described by RFC 7232:
+//   http://tools.ietf.org/html/rfc7232
+
+// Versioner is implemented by persistors that can tell the current version of
+// the item. The version is sent as the entity tag of the item so clients can
+// validate their cached copies and avoid lost updates.
+// The returned value could be a complete entity tag like "W/\"3\"" or just its
+// opaque value, which is then sent as a strong entity tag. Prefer weak entity
+// tags when the view layer is able to produce several MIME types.
+type Versioner interface {
+	ETag() string
+}
+
+// Timestamper is implemented by persistors that can tell the last time the
+// item was modified.
+type Timestamper interface {
+	LastModified() time.Time
+}
+
+// entityTag represents a parsed entity tag.
+type entityTag struct {
+	weak  bool
+	value string
+}
+
+// parseETag parses an entity tag. Values that are not quoted are taken as
+// the opaque value of a strong entity tag.
+func parseETag(tag string) entityTag {
+	tag = strings.TrimSpace(tag)
+	weak := strings.HasPrefix(tag, "W/")
+	if weak {
+		tag = tag[2:]
+	}
+	if len(tag) >= 2 && strings.HasPrefix(tag, `"`) && strings.HasSuffix(tag, `"`) {
+		tag = tag[1 : len(tag)-1]
+	}
+	return entityTag{weak: weak, value: tag}
+}
+
+func (tag entityTag) String() string {
+	if tag.weak {
+		return `W/"` + tag.value + `"`
+	}
+	return `"` + tag.value + `"`
+}
+
+// matchETags reports whether the given entity tag matches any of the entity
+// tags listed in an If-Match or If-None-Match header field value.
+// The strong comparison function only matches strong entity tags.
+func matchETags(header string, current entityTag, strong bool) bool {
+	for _, element := range splitHeader(header) {
+		if element == "*" {
+			return true
+		}
+		tag := parseETag(element)
+		if strong && (tag.weak || current.weak) {
+			continue
+		}
+		if tag.value == current.value {
+			return true
+		}
+	}
+	return false
+}
+
+// validators returns the entity tag and the modification time of the model.
+func validators(model interface{}) (tag *entityTag, modified time.Time) {
+	model = modelItem(model)
+	if versioner, ok := model.(Versioner); ok {
+		if value := versioner.ETag(); value != "" {
+			parsed := parseETag(value)
+			tag = &parsed
+		}
+	}
+	if timestamper, ok := model.(Timestamper); ok {
+		modified = timestamper.LastModified().Truncate(time.Second)
+	}
+	return
+}
+
+// setValidators adds the ETag and Last-Modified headers of the model to the
+// response.
+func setValidators(w http.ResponseWriter, model interface{}) {
+	tag, modified := validators(model)
+	if tag != nil {
+		w.Header().Set(HEADER_ETag, tag.String())
+	}
+	if !modified.IsZero() {
+		w.Header().Set(HEADER_LastModified, modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// preconditionsMet evaluates the If-Match and If-Unmodified-Since headers of
+// the request against the current state of the model. A nil model means the
+// item does not exist.
+func preconditionsMet(model interface{}, r *http.Request) bool {
+	if ifMatch := r.Header.Get(HEADER_IfMatch); ifMatch != "" {
+		if model == nil {
+			return false
+		}
+		tag, _ := validators(model)
+		if strings.TrimSpace(ifMatch) == "*" {
+			return true
+		}
+		return tag != nil && matchETags(ifMatch, *tag, true)
+	}
+	if since, err := http.ParseTime(r.Header.Get(HEADER_IfUnmodifiedSince)); err == nil {
+		if model == nil {
+			return false
+		}
+		_, modified := validators(model)
+		if !modified.IsZero() && modified.After(since) {
+			return false
+		}
+	}
+	return true
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of
+// the request against the current state of the model. It reports whether a
+// "304 Not Modified" response must be sent instead of the model.
+func notModified(model interface{}, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	tag, modified := validators(model)
+	if ifNoneMatch := r.Header.Get(HEADER_IfNoneMatch); ifNoneMatch != "" {
+		return tag != nil && matchETags(ifNoneMatch, *tag, false)
+	}
+	if since, err := http.ParseTime(r.Header.Get(HEADER_IfModifiedSince)); err == nil {
+		return !modified.IsZero() && !modified.After(since)
+	}
+	return false
+}
+
+// modelCopier is implemented by models that know how to copy themselves
+// without sharing the state of their item.
+type modelCopier interface {
+	copyModel() DatabasePersistor
+}
+
+// copyModel returns a copy of the model that can be read without changing the
+// model. Models given by pointer are copied shallowly, so the id they know
+// is kept.
+func copyModel(model DatabasePersistor) DatabasePersistor {
+	if copier, ok := model.(modelCopier); ok {
+		return copier.copyModel()
+	}
+	value := reflect.ValueOf(model)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return model
+	}
+	copied := reflect.New(value.Elem().Type())
+	copied.Elem().Set(value.Elem())
+	return copied.Interface().(DatabasePersistor)
+}
+
+// isConditional reports whether the request has preconditions to evaluate
+// before changing the state of the item.
+func isConditional(r *http.Request) bool {
+	return r.Header.Get(HEADER_IfMatch) != "" || r.Header.Get(HEADER_IfUnmodifiedSince) != ""
+}
+
+// isMissing reports whether the error tells the item does not exist, and not
+// that the read hooks keep it from the client.
+func isMissing(err error) bool {
+	var hook *HookError
+	return errors.Is(err, ErrNotFound) && !errors.As(err, &hook)
+}
+
+// checkPreconditions reads the current state of the model, running the read
+// hooks like Read, and evaluates the preconditions of the request against it.
+// ErrPreconditionFailed is returned when they are not met, including when
+// the item does not exist and the request has an If-Match header, and the
+// error of the read otherwise.
+// The state of the conditional requests is read bypassing the caches, see
+// WithoutCache, so a stale copy of the item can not meet them. The check and
+// the change are not atomic though, so a concurrent change of the item could
+// still go unnoticed.
+func checkPreconditions(view ViewLayer, model DatabasePersistor, cache MemoryCacher, r *http.Request) error {
+	if isConditional(r) {
+		cache = nil
+		r = r.WithContext(WithoutCache(r.Context()))
+	}
+	err := readModel(view, model, cache, r)
+	if isMissing(err) && !preconditionsMet(nil, r) {
+		return ErrPreconditionFailed
+	} else if err != nil {
+		return err
+	}
+	if !preconditionsMet(model, r) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
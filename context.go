@@ -0,0 +1,185 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"context"
+)
+
+// ----------------------------------------------------------------------------
+// CONTEXT
+//
+// The persistence utils pass the context of each request to the models and
+// caches implementing the context aware interfaces below, so a slow query is
+// abandoned when the client goes away or a deadline is reached. Models and
+// caches that only implement DatabasePersistor and MemoryCacher keep working
+// as they are: the context is checked before calling them.
+
+// ContextMemoryCacher is a MemoryCacher that honors the cancellation and the
+// deadline of the given contexts.
+type ContextMemoryCacher interface {
+	SetContext(ctx context.Context, key interface{}, value interface{}) error
+	GetContext(ctx context.Context, key interface{}, value interface{}) error
+	DeleteContext(ctx context.Context, key interface{}) error
+}
+
+// ContextDatabasePersistor is a DatabasePersistor that honors the
+// cancellation and the deadline of the given contexts.
+type ContextDatabasePersistor interface {
+	CreateContext(ctx context.Context) (err error)
+	ReadContext(ctx context.Context, cache MemoryCacher) (err error)
+	UpdateContext(ctx context.Context, cache MemoryCacher) (err error)
+	DeleteContext(ctx context.Context, cache MemoryCacher) (err error)
+	ListContext(ctx context.Context) (result interface{}, err error)
+}
+
+// ContextPaginator is a Paginator that honors the cancellation and the
+// deadline of the given contexts.
+type ContextPaginator interface {
+	ListPageContext(ctx context.Context, request ListRequest) (*Page, error)
+}
+
+// ContextCacher returns the context aware version of the given cache. Caches
+// implementing ContextMemoryCacher are returned as they are, any other cache
+// is adapted to check the context before each operation. Returns nil for a
+// nil cache.
+func ContextCacher(cache MemoryCacher) ContextMemoryCacher {
+	if cache == nil {
+		return nil
+	}
+	if contextCache, ok := cache.(ContextMemoryCacher); ok {
+		return contextCache
+	}
+	return cacherAdapter{cache}
+}
+
+// uncachedKey is the key of the value telling a context asks for uncached
+// reads.
+type uncachedKey struct{}
+
+// WithoutCache returns a copy of the context asking the persistors and the
+// stores to read the items from the database, bypassing their caches. The
+// persistence utils use it to check the preconditions of the requests.
+func WithoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, uncachedKey{}, true)
+}
+
+// CacheBypassed reports whether the context asks for reads bypassing the
+// caches, see WithoutCache.
+func CacheBypassed(ctx context.Context) bool {
+	bypassed, _ := ctx.Value(uncachedKey{}).(bool)
+	return bypassed
+}
+
+// ContextPersistor returns the context aware version of the given model.
+// Models implementing ContextDatabasePersistor are returned as they are, any
+// other model is adapted to check the context before each operation.
+func ContextPersistor(model DatabasePersistor) ContextDatabasePersistor {
+	if contextModel, ok := model.(ContextDatabasePersistor); ok {
+		return contextModel
+	}
+	return persistorAdapter{model}
+}
+
+// cacherAdapter adapts a MemoryCacher to the ContextMemoryCacher interface.
+type cacherAdapter struct {
+	cache MemoryCacher
+}
+
+func (adapter cacherAdapter) SetContext(ctx context.Context, key interface{}, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.cache.Set(key, value)
+}
+
+func (adapter cacherAdapter) GetContext(ctx context.Context, key interface{}, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.cache.Get(key, value)
+}
+
+func (adapter cacherAdapter) DeleteContext(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.cache.Delete(key)
+}
+
+// persistorAdapter adapts a DatabasePersistor to the ContextDatabasePersistor
+// interface.
+type persistorAdapter struct {
+	model DatabasePersistor
+}
+
+func (adapter persistorAdapter) CreateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.model.Create()
+}
+
+func (adapter persistorAdapter) ReadContext(ctx context.Context, cache MemoryCacher) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.model.Read(cache)
+}
+
+func (adapter persistorAdapter) UpdateContext(ctx context.Context, cache MemoryCacher) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.model.Update(cache)
+}
+
+func (adapter persistorAdapter) DeleteContext(ctx context.Context, cache MemoryCacher) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return adapter.model.Delete(cache)
+}
+
+func (adapter persistorAdapter) ListContext(ctx context.Context) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return adapter.model.List()
+}
+
+// isPaginator reports whether the model is a Paginator or a ContextPaginator.
+func isPaginator(model DatabasePersistor) bool {
+	_, paginator := model.(Paginator)
+	_, contextPaginator := model.(ContextPaginator)
+	return paginator || contextPaginator
+}
+
+// listPage reads the requested page of a Paginator or a ContextPaginator.
+func listPage(ctx context.Context, model DatabasePersistor, request ListRequest) (*Page, error) {
+	if paginator, ok := model.(ContextPaginator); ok {
+		return paginator.ListPageContext(ctx, request)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return model.(Paginator).ListPage(request)
+}
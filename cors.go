@@ -0,0 +1,218 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// CROSS-ORIGIN RESOURCE SHARING
+//
+// CORS as described by the Fetch standard:
+//   https://fetch.spec.whatwg.org/#http-cors-protocol
+
+// CORS represents the Cross-Origin Resource Sharing policy of an API.
+//
+// AllowedOrigins lists the origins allowed to access the API. "*" allows any
+// origin and a "*" inside an origin matches any part of it, like in
+// "https://*.example.com". OriginPatterns are regular expressions matched
+// against the whole origin.
+// AllowedHeaders lists the request headers clients are allowed to send, "*"
+// allows any of them. ExposedHeaders lists the response headers the browser
+// scripts are allowed to read.
+// MaxAge tells the browsers for how long they can cache preflight responses.
+//
+// AllowCredentials lets the browsers send cookies and authorization headers
+// to the API and read the responses. It must be used with explicit origins
+// or patterns: allowing credentials from any origin would let any site make
+// authenticated requests on behalf of the users, so Handler panics when
+// AllowedOrigins has "*" and AllowCredentials is true.
+type CORS struct {
+	AllowedOrigins   []string
+	OriginPatterns   []*regexp.Regexp
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// NewCORS creates a CORS policy for the given origins that allows the
+// methods and headers used by skue resources and exposes the headers skue
+// sends to the clients.
+func NewCORS(origins ...string) *CORS {
+	return &CORS{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{HEADER_Accept, HEADER_ContentType, HEADER_IfMatch, HEADER_IfNoneMatch,
+			HEADER_IfModifiedSince, HEADER_IfUnmodifiedSince},
+		ExposedHeaders: []string{HEADER_ETag, HEADER_LastModified, HEADER_Link, HEADER_XTotalCount,
+			HEADER_XRateLimitLimit, HEADER_XRateLimitRemaining},
+	}
+}
+
+// matchOrigin reports whether the origin matches a pattern with wildcards.
+func matchOrigin(pattern, origin string) bool {
+	parts := strings.Split(strings.ToLower(pattern), "*")
+	origin = strings.ToLower(origin)
+	if len(parts) == 1 {
+		return parts[0] == origin
+	}
+	if !strings.HasPrefix(origin, parts[0]) {
+		return false
+	}
+	origin = origin[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(origin, part)
+		if i < 0 {
+			return false
+		}
+		origin = origin[i+len(part):]
+	}
+	return strings.HasSuffix(origin, parts[len(parts)-1])
+}
+
+// allowsAnyOrigin reports whether the policy allows any origin.
+func (cors *CORS) allowsAnyOrigin() bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOrigin reports whether the given origin is allowed by the policy.
+// The "*" origin allows none when credentials are allowed.
+func (cors *CORS) AllowsOrigin(origin string) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" && cors.AllowCredentials {
+			continue
+		}
+		if matchOrigin(allowed, origin) {
+			return true
+		}
+	}
+	for _, pattern := range cors.OriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMethod reports whether the given method is allowed by the policy.
+func (cors *CORS) allowsMethod(method string) bool {
+	for _, allowed := range cors.AllowedMethods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders reports whether all the given headers are allowed by the
+// policy.
+func (cors *CORS) allowsHeaders(headers []string) bool {
+	for _, header := range headers {
+		found := false
+		for _, allowed := range cors.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// setAllowOrigin sets the headers telling the browser the origin is allowed.
+func (cors *CORS) setAllowOrigin(header http.Header, origin string) {
+	if cors.allowsAnyOrigin() && !cors.AllowCredentials {
+		header.Set(HEADER_AccessControlAllowOrigin, "*")
+	} else {
+		header.Set(HEADER_AccessControlAllowOrigin, origin)
+		AddVary(header, HEADER_Origin)
+	}
+	if cors.AllowCredentials {
+		header.Set(HEADER_AccessControlAllowCredentials, "true")
+	}
+}
+
+// preflight answers a CORS preflight request.
+func (cors *CORS) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	header := w.Header()
+	AddVary(header, HEADER_Origin, HEADER_AccessControlRequestMethod, HEADER_AccessControlRequestHeaders)
+	method := r.Header.Get(HEADER_AccessControlRequestMethod)
+	requested := splitHeader(r.Header.Get(HEADER_AccessControlRequestHeaders))
+	// Preflights that are not allowed get an answer without the CORS
+	// headers so the browser blocks the actual request
+	if !cors.AllowsOrigin(origin) || !cors.allowsMethod(method) || !cors.allowsHeaders(requested) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	cors.setAllowOrigin(header, origin)
+	header.Set(HEADER_AccessControlAllowMethods, strings.Join(cors.AllowedMethods, ", "))
+	if len(requested) > 0 {
+		header.Set(HEADER_AccessControlAllowHeaders, strings.Join(requested, ", "))
+	}
+	if cors.MaxAge > 0 {
+		header.Set(HEADER_AccessControlMaxAge, strconv.Itoa(int(cors.MaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler wraps the given handler applying the CORS policy. Preflight
+// requests are answered by the returned handler without reaching the wrapped
+// handler. It panics if the policy allows credentials from any origin.
+func (cors *CORS) Handler(handler http.Handler) http.Handler {
+	if cors.allowsAnyOrigin() && cors.AllowCredentials {
+		panic("skue: CORS can not allow credentials from any origin, list the allowed origins instead of \"*\"")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(HEADER_Origin)
+		if origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == "OPTIONS" && r.Header.Get(HEADER_AccessControlRequestMethod) != "" {
+			cors.preflight(w, r, origin)
+			return
+		}
+		if cors.AllowsOrigin(origin) {
+			cors.setAllowOrigin(w.Header(), origin)
+			if len(cors.ExposedHeaders) > 0 {
+				w.Header().Set(HEADER_AccessControlExposeHeaders, strings.Join(cors.ExposedHeaders, ", "))
+			}
+		} else {
+			AddVary(w.Header(), HEADER_Origin)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestAllowsOrigin(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile(`^https://[a-z]+\.example\.org$`)}
+	tests := []struct {
+		name        string
+		origins     []string
+		patterns    []*regexp.Regexp
+		credentials bool
+		origin      string
+		want        bool
+	}{
+		{"explicit", []string{"https://example.com"}, nil, false, "https://example.com", true},
+		{"case", []string{"https://Example.com"}, nil, false, "https://example.COM", true},
+		{"other", []string{"https://example.com"}, nil, false, "https://evil.com", false},
+		{"wildcard", []string{"https://*.example.com"}, nil, false, "https://api.example.com", true},
+		{"wildcard suffix", []string{"https://*.example.com"}, nil, false, "https://example.com.evil.com", false},
+		{"any", []string{"*"}, nil, false, "https://evil.com", true},
+		// Handler panics with this policy, but AllowsOrigin can still be
+		// called directly
+		{"any with credentials", []string{"*"}, nil, true, "https://evil.com", false},
+		{"explicit with credentials", []string{"*", "https://example.com"}, nil, true, "https://example.com", true},
+		{"pattern", nil, patterns, false, "https://api.example.org", true},
+		{"pattern mismatch", nil, patterns, false, "https://api.example.org.evil.com", false},
+		{"pattern with credentials", nil, patterns, true, "https://api.example.org", true},
+	}
+	for _, test := range tests {
+		cors := &CORS{AllowedOrigins: test.origins, OriginPatterns: test.patterns, AllowCredentials: test.credentials}
+		if got := cors.AllowsOrigin(test.origin); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHandlerCredentialsFromAnyOrigin(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Handler allowed credentials from any origin")
+		}
+	}()
+	cors := NewCORS("*")
+	cors.AllowCredentials = true
+	cors.Handler(http.NotFoundHandler())
+}
@@ -0,0 +1,639 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/greivinlopez/skue"
+	"github.com/greivinlopez/skue/database"
+	"gopkg.in/mgo.v2/bson"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = skue.ErrNotFound
+
+// MemoryPersistor keeps the documents of its collections in memory. It
+// follows the same operations of the MongoDBPersistor, and the documents are
+// stored as BSON just like MongoDB would, so models can be tested or
+// prototyped with no database server and then moved to MongoDB unchanged.
+// Queries support the equality and the $ne, $gt, $gte, $lt, $lte, $in,
+// $and and $or operators.
+// It is safe for concurrent use and documents are copied in and out, so
+// callers can not change the stored documents.
+type MemoryPersistor struct {
+	// ErrorLog logs the errors that are not returned, like the cache errors
+	// after a document is changed. The standard logger is used when it is
+	// nil.
+	ErrorLog *log.Logger
+
+	mutex       sync.RWMutex
+	collections map[string][]*record
+}
+
+// record is a stored document, both encoded and decoded.
+type record struct {
+	data []byte
+	doc  bson.M
+}
+
+// New creates a new empty MemoryPersistor.
+func New() *MemoryPersistor {
+	return &MemoryPersistor{
+		collections: map[string][]*record{},
+	}
+}
+
+// newRecord encodes the given document as BSON.
+func newRecord(document interface{}) (*record, error) {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return &record{data: data, doc: doc}, nil
+}
+
+// withID returns a copy of the record with the given _id.
+func (rec *record) withID(id interface{}) (*record, error) {
+	doc := bson.M{}
+	for key, value := range rec.doc {
+		doc[key] = value
+	}
+	doc["_id"] = id
+	return newRecord(doc)
+}
+
+// logf logs an error of the persistor that is not returned.
+func (memory *MemoryPersistor) logf(format string, args ...interface{}) {
+	if memory.ErrorLog != nil {
+		memory.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// bsonValue returns the value as it is stored in the BSON documents, so
+// values of named types, like the ids of type TeamID string, or of other
+// number types are compared just like MongoDB does.
+func bsonValue(value interface{}) interface{} {
+	data, err := bson.Marshal(bson.M{"value": value})
+	if err != nil {
+		return value
+	}
+	doc := bson.M{}
+	if err = bson.Unmarshal(data, &doc); err != nil {
+		return value
+	}
+	return doc["value"]
+}
+
+// find returns the position of the document with the given id in the
+// collection, or -1 if there is none. The lock must be held.
+func (memory *MemoryPersistor) find(collection string, idfield string, id interface{}) int {
+	id = bsonValue(id)
+	for i, rec := range memory.collections[collection] {
+		if value, found := lookup(rec.doc, idfield); found && equal(value, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ----------------------------------------------------------------------------
+// 			Operations
+// ----------------------------------------------------------------------------
+
+// Drop removes all the elements from the given collection
+func (memory *MemoryPersistor) Drop(collectionName string) (err error) {
+	return memory.DropContext(context.Background(), collectionName)
+}
+
+// DropContext removes all the elements from the given collection unless the
+// context is done.
+func (memory *MemoryPersistor) DropContext(ctx context.Context, collectionName string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	delete(memory.collections, collectionName)
+	return nil
+}
+
+// Count returns the number of elements of the given collection
+func (memory *MemoryPersistor) Count(collectionName string) (n int, err error) {
+	return memory.CountContext(context.Background(), collectionName)
+}
+
+// CountContext returns the number of elements of the given collection
+// unless the context is done.
+func (memory *MemoryPersistor) CountContext(ctx context.Context, collectionName string) (n int, err error) {
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+	return len(memory.collections[collectionName]), nil
+}
+
+// Create saves the given document into the provided collection. Documents
+// without an _id get a new ObjectId, like MongoDB does, and documents with
+// an _id already in the collection are rejected with skue.ErrConflict.
+func (memory *MemoryPersistor) Create(document interface{}, collection string) (err error) {
+	return memory.CreateContext(context.Background(), document, collection)
+}
+
+// CreateContext saves the given document into the provided collection
+// unless the context is done.
+func (memory *MemoryPersistor) CreateContext(ctx context.Context, document interface{}, collection string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	rec, err := newRecord(document)
+	if err != nil {
+		return err
+	}
+	if rec.doc["_id"] == nil {
+		if rec, err = rec.withID(bson.NewObjectId()); err != nil {
+			return err
+		}
+	}
+	memory.mutex.Lock()
+	defer memory.mutex.Unlock()
+	if memory.find(collection, "_id", rec.doc["_id"]) >= 0 {
+		return fmt.Errorf("duplicate key %v in %s: %w", rec.doc["_id"], collection, skue.ErrConflict)
+	}
+	memory.collections[collection] = append(memory.collections[collection], rec)
+	return nil
+}
+
+// Gets a list of documents from the given collection
+// The documents parameter must be a pointer to a slice. A limit of 0 means
+// no limit.
+func (memory *MemoryPersistor) List(documents interface{}, collection string, query interface{}, limit int) (err error) {
+	return memory.ListContext(context.Background(), documents, collection, query, limit)
+}
+
+// ListContext gets a list of documents from the given collection unless the
+// context is done.
+func (memory *MemoryPersistor) ListContext(ctx context.Context, documents interface{}, collection string, query interface{}, limit int) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	records, err := memory.query(collection, query)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return decodeAll(records, documents)
+}
+
+// ListPage gets a page of documents from the given collection, just like
+// the ListPage of the MongoDBPersistor: cursors are only available when the
+// documents are not sorted, and pages requested by offset include the total
+// number of documents.
+// The documents parameter must be a pointer to a slice.
+func (memory *MemoryPersistor) ListPage(documents interface{}, collection string, query interface{}, idfield string, request skue.ListRequest) (page *skue.Page, err error) {
+	return memory.ListPageContext(context.Background(), documents, collection, query, idfield, request)
+}
+
+// ListPageContext gets a page of documents from the given collection like
+// ListPage unless the context is done.
+func (memory *MemoryPersistor) ListPageContext(ctx context.Context, documents interface{}, collection string, query interface{}, idfield string, request skue.ListRequest) (page *skue.Page, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	pageQuery, err := mongodb.NewPageQuery(query, idfield, request)
+	if err != nil {
+		return nil, err
+	}
+	records, err := memory.query(collection, pageQuery.Query)
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records, pageQuery.Sort)
+	total := len(records)
+	if request.Offset >= len(records) {
+		records = nil
+	} else {
+		records = records[request.Offset:]
+	}
+	if request.Limit > 0 && len(records) > request.Limit {
+		records = records[:request.Limit]
+	}
+	if err = decodeAll(records, documents); err != nil {
+		return nil, err
+	}
+	return pageQuery.Page(documents, total)
+}
+
+// Read retrieves the document associated with the given collection+id trying the given
+// memory cache first.
+func (memory *MemoryPersistor) Read(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	return memory.ReadContext(context.Background(), cache, document, collection, idfield, id)
+}
+
+// ReadContext retrieves the document associated with the given collection+id
+// trying the given memory cache first, unless the context is done. The cache
+// is not used when the context asks to bypass it, see skue.WithoutCache.
+func (memory *MemoryPersistor) ReadContext(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	if skue.CacheBypassed(ctx) {
+		cache = nil
+	}
+	// The document is cached again after any error of the cache but the
+	// ones telling it is unavailable
+	refill := false
+	if cache != nil {
+		err = skue.ContextCacher(cache).GetContext(ctx, mongodb.CacheKey(collection, id), document)
+		if err == nil {
+			return nil
+		}
+		refill = !errors.Is(err, skue.ErrUnavailable)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	memory.mutex.RLock()
+	i := memory.find(collection, idfield, id)
+	var data []byte
+	if i >= 0 {
+		data = memory.collections[collection][i].data
+	}
+	memory.mutex.RUnlock()
+	if i < 0 {
+		return ErrNotFound
+	}
+	if err = bson.Unmarshal(data, document); err != nil {
+		return err
+	}
+
+	// The document was read anyway, so the errors of the cache are logged,
+	// not returned
+	if refill {
+		key := mongodb.CacheKey(collection, id)
+		if err = skue.ContextCacher(cache).SetContext(ctx, key, document); err != nil {
+			memory.logf("memory: caching %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Update changes the given document on the database (and the given cache if not nil)
+func (memory *MemoryPersistor) Update(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	return memory.UpdateContext(context.Background(), cache, document, collection, idfield, id)
+}
+
+// UpdateContext changes the given document on the database (and the given
+// cache if not nil) unless the context is done. Once the document is changed
+// the errors of the cache are logged, not returned, like the MongoDB
+// persistor does.
+func (memory *MemoryPersistor) UpdateContext(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	rec, err := newRecord(document)
+	if err != nil {
+		return err
+	}
+	memory.mutex.Lock()
+	i := memory.find(collection, idfield, id)
+	if i >= 0 {
+		// The _id of a document never changes
+		rec, err = rec.withID(memory.collections[collection][i].doc["_id"])
+		if err == nil {
+			memory.collections[collection][i] = rec
+		}
+	}
+	memory.mutex.Unlock()
+	if i < 0 {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if cache != nil {
+		key := mongodb.CacheKey(collection, id)
+		if err = skue.ContextCacher(cache).SetContext(context.WithoutCancel(ctx), key, document); err != nil {
+			memory.logf("memory: caching %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes the document associated with the given collection+id from the database
+// and from the cache system given if any.
+func (memory *MemoryPersistor) Delete(cache skue.MemoryCacher, collection string, idfield string, id interface{}) (err error) {
+	return memory.DeleteContext(context.Background(), cache, collection, idfield, id)
+}
+
+// DeleteContext removes the document associated with the given collection+id
+// from the database and from the cache system given if any, unless the
+// context is done. Once the document is removed the errors of the cache are
+// logged, not returned.
+func (memory *MemoryPersistor) DeleteContext(ctx context.Context, cache skue.MemoryCacher, collection string, idfield string, id interface{}) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	memory.mutex.Lock()
+	i := memory.find(collection, idfield, id)
+	if i >= 0 {
+		records := memory.collections[collection]
+		memory.collections[collection] = append(records[:i:i], records[i+1:]...)
+	}
+	memory.mutex.Unlock()
+	if i < 0 {
+		return ErrNotFound
+	}
+
+	if cache != nil {
+		key := mongodb.CacheKey(collection, id)
+		if err = skue.ContextCacher(cache).DeleteContext(context.WithoutCancel(ctx), key); err != nil {
+			memory.logf("memory: removing %s from the cache: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// 			Queries
+// ----------------------------------------------------------------------------
+
+// query returns the records of the collection matching the query, in the
+// order they were created.
+func (memory *MemoryPersistor) query(collection string, query interface{}) ([]*record, error) {
+	filter := bson.M{}
+	if query != nil {
+		data, err := bson.Marshal(query)
+		if err == nil {
+			err = bson.Unmarshal(data, &filter)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %v", err)
+		}
+	}
+	memory.mutex.RLock()
+	defer memory.mutex.RUnlock()
+	records := []*record{}
+	for _, rec := range memory.collections[collection] {
+		ok, err := matches(rec.doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+// decodeAll decodes the records into the slice pointed by documents.
+func decodeAll(records []*record, documents interface{}) error {
+	slice := reflect.ValueOf(documents)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("documents must be a pointer to a slice, not %T", documents)
+	}
+	slice = slice.Elem()
+	result := reflect.MakeSlice(slice.Type(), 0, len(records))
+	for _, rec := range records {
+		item := reflect.New(slice.Type().Elem())
+		if err := bson.Unmarshal(rec.data, item.Interface()); err != nil {
+			return err
+		}
+		result = reflect.Append(result, item.Elem())
+	}
+	slice.Set(result)
+	return nil
+}
+
+// sortRecords sorts the records by the given fields, descending for the
+// fields starting with "-". Missing values come first, like in MongoDB.
+func sortRecords(records []*record, fields []string) {
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, field := range fields {
+			descending := strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+			a, foundA := lookup(records[i].doc, field)
+			b, foundB := lookup(records[j].doc, field)
+			order := 0
+			switch {
+			case !foundA && foundB:
+				order = -1
+			case foundA && !foundB:
+				order = 1
+			case foundA && foundB:
+				order, _ = compare(a, b)
+			}
+			if order != 0 {
+				return (order < 0) != descending
+			}
+		}
+		return false
+	})
+}
+
+// lookup returns the value at the given dotted path of the document.
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		current, ok := value.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = current[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// matches reports whether the document matches the query.
+func matches(doc bson.M, query bson.M) (bool, error) {
+	for key, condition := range query {
+		switch key {
+		case "$and", "$or":
+			list, ok := condition.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("%s needs a list of queries", key)
+			}
+			matched := false
+			for _, item := range list {
+				subquery, ok := item.(bson.M)
+				if !ok {
+					return false, fmt.Errorf("%s needs a list of queries", key)
+				}
+				ok, err := matches(doc, subquery)
+				if err != nil {
+					return false, err
+				}
+				if key == "$and" && !ok {
+					return false, nil
+				}
+				matched = matched || ok
+			}
+			if key == "$or" && !matched {
+				return false, nil
+			}
+		default:
+			value, found := lookup(doc, key)
+			ok, err := matchCondition(value, found, condition)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchCondition reports whether the value matches the condition for its
+// field, either a value or a document of operators.
+func matchCondition(value interface{}, found bool, condition interface{}) (bool, error) {
+	operators, ok := condition.(bson.M)
+	isOperators := ok && len(operators) > 0
+	for operator := range operators {
+		isOperators = isOperators && strings.HasPrefix(operator, "$")
+	}
+	if !isOperators {
+		return found && matchValue(value, condition), nil
+	}
+	for operator, argument := range operators {
+		var ok bool
+		switch operator {
+		case "$ne":
+			ok = !found || !matchValue(value, argument)
+		case "$in":
+			list, isList := argument.([]interface{})
+			if !isList {
+				return false, errors.New("$in needs a list of values")
+			}
+			for _, item := range list {
+				ok = ok || (found && matchValue(value, item))
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			order, comparable := compare(value, argument)
+			ok = found && comparable && ((operator == "$gt" && order > 0) ||
+				(operator == "$gte" && order >= 0) ||
+				(operator == "$lt" && order < 0) ||
+				(operator == "$lte" && order <= 0))
+		default:
+			return false, fmt.Errorf("unsupported query operator %s", operator)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchValue reports whether the value is equal to the expected one or, for
+// arrays, whether one of its items is.
+func matchValue(value, expected interface{}) bool {
+	if equal(value, expected) {
+		return true
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if equal(item, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// equal reports whether both values are equal, numbers of different types
+// included.
+func equal(a, b interface{}) bool {
+	if order, ok := compare(a, b); ok {
+		return order == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// number returns the value of numbers as a float64.
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// compare returns the order of both values, reporting whether they can be
+// compared at all.
+func compare(a, b interface{}) (int, bool) {
+	order := func(less, greater bool) int {
+		switch {
+		case less:
+			return -1
+		case greater:
+			return 1
+		}
+		return 0
+	}
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return order(x < y, x > y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bson.ObjectId:
+		if y, ok := b.(bson.ObjectId); ok {
+			return strings.Compare(string(x), string(y)), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			return order(!x && y, x && !y), true
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			return order(x.Before(y), x.After(y)), true
+		}
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,467 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/greivinlopez/skue"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type player struct {
+	Id   int    `bson:"_id"`
+	Name string `bson:"name"`
+	Age  int    `bson:"age"`
+}
+
+func TestMatches(t *testing.T) {
+	doc := bson.M{
+		"name": "Keylor",
+		"age":  28,
+		"team": bson.M{"name": "Saprissa"},
+		"tags": []interface{}{"goalkeeper", "captain"},
+	}
+	tests := []struct {
+		name  string
+		query bson.M
+		want  bool
+		err   bool
+	}{
+		{"empty", bson.M{}, true, false},
+		{"equal", bson.M{"name": "Keylor"}, true, false},
+		{"not equal", bson.M{"name": "Bryan"}, false, false},
+		{"number types", bson.M{"age": int64(28)}, true, false},
+		{"dotted path", bson.M{"team.name": "Saprissa"}, true, false},
+		{"missing field", bson.M{"number": 1}, false, false},
+		{"array item", bson.M{"tags": "captain"}, true, false},
+		{"$ne", bson.M{"name": bson.M{"$ne": "Bryan"}}, true, false},
+		{"$ne missing", bson.M{"number": bson.M{"$ne": 1}}, true, false},
+		{"$gt", bson.M{"age": bson.M{"$gt": 27}}, true, false},
+		{"$gte", bson.M{"age": bson.M{"$gte": 28.0}}, true, false},
+		{"$lt", bson.M{"age": bson.M{"$lt": 28}}, false, false},
+		{"$lte", bson.M{"age": bson.M{"$lte": 28}}, true, false},
+		{"range", bson.M{"age": bson.M{"$gt": 20, "$lt": 30}}, true, false},
+		{"$gt other type", bson.M{"age": bson.M{"$gt": "20"}}, false, false},
+		{"$in", bson.M{"name": bson.M{"$in": []interface{}{"Bryan", "Keylor"}}}, true, false},
+		{"$in none", bson.M{"name": bson.M{"$in": []interface{}{"Bryan"}}}, false, false},
+		{"$and", bson.M{"$and": []interface{}{bson.M{"name": "Keylor"}, bson.M{"age": 28}}}, true, false},
+		{"$and one", bson.M{"$and": []interface{}{bson.M{"name": "Keylor"}, bson.M{"age": 30}}}, false, false},
+		{"$or", bson.M{"$or": []interface{}{bson.M{"name": "Bryan"}, bson.M{"age": 28}}}, true, false},
+		{"$or none", bson.M{"$or": []interface{}{bson.M{"name": "Bryan"}, bson.M{"age": 30}}}, false, false},
+		{"$in no list", bson.M{"name": bson.M{"$in": "Keylor"}}, false, true},
+		{"$and no list", bson.M{"$and": bson.M{"name": "Keylor"}}, false, true},
+		{"unsupported operator", bson.M{"name": bson.M{"$regex": "K"}}, false, true},
+	}
+	for _, test := range tests {
+		got, err := matches(doc, test.query)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	id := bson.NewObjectId()
+	tests := []struct {
+		a, b       interface{}
+		order      int
+		comparable bool
+	}{
+		{1, 2, -1, true},
+		{int32(2), int64(2), 0, true},
+		{2.5, 2, 1, true},
+		{"a", "b", -1, true},
+		{"b", "b", 0, true},
+		{false, true, -1, true},
+		{true, false, 1, true},
+		{now, now.Add(time.Second), -1, true},
+		{id, id, 0, true},
+		{nil, nil, 0, true},
+		{1, "1", 0, false},
+		{"1", 1, 0, false},
+		{nil, 1, 0, false},
+		{bson.M{}, bson.M{}, 0, false},
+	}
+	for _, test := range tests {
+		order, comparable := compare(test.a, test.b)
+		if order != test.order || comparable != test.comparable {
+			t.Errorf("compare(%v, %v) = %d, %v, want %d, %v", test.a, test.b, order, comparable, test.order, test.comparable)
+		}
+	}
+}
+
+func TestSortRecords(t *testing.T) {
+	tests := []struct {
+		fields []string
+		want   []int
+	}{
+		{[]string{"name"}, []int{4, 1, 3, 2}},
+		{[]string{"-name"}, []int{2, 3, 1, 4}},
+		{[]string{"age", "name"}, []int{4, 3, 1, 2}},
+		{[]string{"age", "-name"}, []int{4, 3, 2, 1}},
+		{[]string{}, []int{1, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		records := []*record{}
+		for _, doc := range []bson.M{
+			{"_id": 1, "name": "Bryan", "age": 30},
+			{"_id": 2, "name": "Keylor", "age": 30},
+			{"_id": 3, "name": "Joel", "age": 25},
+			// Missing values come first
+			{"_id": 4},
+		} {
+			rec, err := newRecord(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, rec)
+		}
+		sortRecords(records, test.fields)
+		for i, rec := range records {
+			if !equal(rec.doc["_id"], test.want[i]) {
+				t.Errorf("%v: got %v at %d, want %d", test.fields, rec.doc["_id"], i, test.want[i])
+			}
+		}
+	}
+}
+
+func TestCreateRead(t *testing.T) {
+	memory := New()
+	if err := memory.Create(&player{Id: 1, Name: "Keylor"}, "players"); err != nil {
+		t.Fatal(err)
+	}
+	err := memory.Create(&player{Id: 1, Name: "Bryan"}, "players")
+	if !errors.Is(err, skue.ErrConflict) {
+		t.Errorf("got %v creating a duplicate, want skue.ErrConflict", err)
+	}
+
+	found := player{}
+	if err = memory.Read(nil, &found, "players", "_id", 1); err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Keylor" {
+		t.Errorf("got %q, want Keylor", found.Name)
+	}
+	if err = memory.Read(nil, &found, "players", "_id", 2); err != ErrNotFound {
+		t.Errorf("got %v reading a missing document, want ErrNotFound", err)
+	}
+}
+
+// brokenCache is a MemoryCacher whose operations fail with the given errors.
+type brokenCache struct {
+	getErr, setErr error
+	sets           int
+}
+
+func (cache *brokenCache) Set(key interface{}, value interface{}) error {
+	cache.sets++
+	return cache.setErr
+}
+
+func (cache *brokenCache) Get(key interface{}, value interface{}) error {
+	return cache.getErr
+}
+
+func (cache *brokenCache) Delete(key interface{}) error {
+	return nil
+}
+
+func TestReadCacheErrors(t *testing.T) {
+	memory := New()
+	memory.ErrorLog = log.New(io.Discard, "", 0)
+	if err := memory.Create(&player{Id: 1, Name: "Keylor"}, "players"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cache  *brokenCache
+		cached bool
+	}{
+		{"miss", &brokenCache{getErr: skue.ErrCacheMiss}, true},
+		{"unclassified miss", &brokenCache{getErr: errors.New("memcache: cache miss")}, true},
+		{"unavailable", &brokenCache{getErr: skue.ErrUnavailable}, false},
+		{"failed set", &brokenCache{getErr: skue.ErrCacheMiss, setErr: errors.New("redis OOM")}, true},
+	}
+	for _, test := range tests {
+		found := player{}
+		if err := memory.Read(test.cache, &found, "players", "_id", 1); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if found.Name != "Keylor" {
+			t.Errorf("%s: got %q, want Keylor", test.name, found.Name)
+		}
+		if cached := test.cache.sets > 0; cached != test.cached {
+			t.Errorf("%s: got cached %v, want %v", test.name, cached, test.cached)
+		}
+	}
+}
+
+func TestListPageCursors(t *testing.T) {
+	memory := New()
+	for _, id := range []int{3, 5, 1, 4, 2} {
+		if err := memory.Create(&player{Id: id, Age: 20 + id}, "players"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	request := skue.ListRequest{Limit: 2}
+	pages := [][]int{}
+	for {
+		players := []player{}
+		page, err := memory.ListPage(&players, "players", nil, "_id", request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, p := range players {
+			ids = append(ids, p.Id)
+		}
+		pages = append(pages, ids)
+		if page.NextCursor == "" {
+			break
+		}
+		request.Cursor = page.NextCursor
+	}
+	want := [][]int{{1, 2}, {3, 4}, {5}}
+	if len(pages) != len(want) {
+		t.Fatalf("got pages %v, want %v", pages, want)
+	}
+	for i := range want {
+		if len(pages[i]) != len(want[i]) {
+			t.Fatalf("got pages %v, want %v", pages, want)
+		}
+		for j := range want[i] {
+			if pages[i][j] != want[i][j] {
+				t.Fatalf("got pages %v, want %v", pages, want)
+			}
+		}
+	}
+
+	// Walking back from the last page
+	back := [][]int{}
+	var next []int
+	for previous := request; previous.Cursor != ""; {
+		players := []player{}
+		page, err := memory.ListPage(&players, "players", nil, "_id", previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []int{}
+		for _, p := range players {
+			ids = append(ids, p.Id)
+		}
+		back = append(back, ids)
+		if len(back) == 2 {
+			nextPlayers := []player{}
+			memory.ListPage(&nextPlayers, "players", nil, "_id", skue.ListRequest{Limit: 2, Cursor: page.NextCursor})
+			for _, p := range nextPlayers {
+				next = append(next, p.Id)
+			}
+		}
+		previous.Cursor = page.PrevCursor
+	}
+	if got, want := fmt.Sprint(back), "[[5] [3 4] [1 2] []]"; got != want {
+		t.Errorf("got pages %s walking back, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(next), "[5]"; got != want {
+		t.Errorf("got %s after a previous page, want %s", got, want)
+	}
+
+	tests := []struct {
+		name    string
+		request skue.ListRequest
+		total   int
+		first   int
+		err     bool
+	}{
+		{"offset", skue.ListRequest{Limit: 2, Offset: 2}, 5, 3, false},
+		{"sorted", skue.ListRequest{Limit: 2, Query: skue.Query{Sort: []skue.SortField{{Field: "age", Descending: true}}}}, 5, 5, false},
+		{"filtered", skue.ListRequest{Query: skue.Query{Conditions: []skue.Condition{{Field: "age", Operator: skue.OpEqual, Value: 22}}}}, 1, 2, false},
+		{"sorted with cursor", skue.ListRequest{Limit: 2, Cursor: request.Cursor, Query: skue.Query{Sort: []skue.SortField{{Field: "age"}}}}, 0, 0, true},
+		{"invalid cursor", skue.ListRequest{Limit: 2, Cursor: "invalid"}, 0, 0, true},
+	}
+	for _, test := range tests {
+		players := []player{}
+		page, err := memory.ListPage(&players, "players", nil, "_id", test.request)
+		if test.err {
+			var problem *skue.Problem
+			if !errors.As(err, &problem) {
+				t.Errorf("%s: got %v, want a problem", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if page.Total != test.total || len(players) == 0 || players[0].Id != test.first {
+			t.Errorf("%s: got %v with total %d, want %d first with total %d", test.name, players, page.Total, test.first, test.total)
+		}
+	}
+}
+
+type coach struct {
+	Code string `bson:"_id,omitempty" skue:"id"`
+	Name string `bson:"name"`
+}
+
+type secretCoach struct {
+	Code string `bson:"-" skue:"id"`
+}
+
+func TestNewStoreIDField(t *testing.T) {
+	store := NewStore[coach, string](New(), "coaches", nil)
+	if store.idfield != "_id" {
+		t.Errorf("got id field %q, want _id", store.idfield)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("got a store for an id field that is not stored, want a panic")
+		}
+	}()
+	NewStore[secretCoach, string](New(), "coaches", nil)
+}
+
+type TeamID string
+
+type team struct {
+	Id   TeamID `bson:"_id" skue:"id"`
+	Name string `bson:"name"`
+}
+
+type shirt struct {
+	Number uint   `bson:"_id" skue:"id"`
+	Owner  string `bson:"owner"`
+}
+
+func TestStoreIDTypes(t *testing.T) {
+	ctx := context.Background()
+	teams := NewStore[team, TeamID](New(), "teams", nil)
+	if err := teams.Create(ctx, &team{"saprissa", "Saprissa"}); err != nil {
+		t.Fatal(err)
+	}
+	found, err := teams.Get(ctx, "saprissa")
+	if err != nil || found.Name != "Saprissa" {
+		t.Errorf("got %+v, %v reading a named string id, want Saprissa", found, err)
+	}
+	if err = teams.Create(ctx, &team{"saprissa", "Other"}); !errors.Is(err, skue.ErrConflict) {
+		t.Errorf("got %v creating a duplicate named string id, want skue.ErrConflict", err)
+	}
+
+	shirts := NewStore[shirt, uint](New(), "shirts", nil)
+	if err = shirts.Create(ctx, &shirt{1, "Keylor"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := shirts.Get(ctx, 1); err != nil || found.Owner != "Keylor" {
+		t.Errorf("got %+v, %v reading an uint id, want Keylor", found, err)
+	}
+	if err = shirts.Update(ctx, 1, &shirt{1, "Navas"}); err != nil {
+		t.Errorf("got %v updating an uint id", err)
+	}
+	if err = shirts.Delete(ctx, 1); err != nil {
+		t.Errorf("got %v deleting an uint id", err)
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	memory := New()
+	memory.ErrorLog = log.New(io.Discard, "", 0)
+	for _, p := range []player{{1, "Keylor", 28}, {2, "Bryan", 25}} {
+		if err := memory.Create(&p, "players"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache := &brokenCache{getErr: skue.ErrCacheMiss}
+
+	if err := memory.Update(cache, &player{Id: 9, Name: "Navas", Age: 29}, "players", "_id", 1); err != nil {
+		t.Fatal(err)
+	}
+	found := player{}
+	if err := memory.Read(nil, &found, "players", "_id", 1); err != nil || found.Name != "Navas" || found.Id != 1 {
+		t.Errorf("got %+v, %v, want Navas keeping the _id 1", found, err)
+	}
+	if cache.sets != 1 {
+		t.Errorf("got %d sets, want the updated document cached", cache.sets)
+	}
+	if err := memory.Update(nil, &player{Name: "Joel"}, "players", "_id", 3); err != ErrNotFound {
+		t.Errorf("got %v updating a missing document, want ErrNotFound", err)
+	}
+
+	if err := memory.Delete(nil, "players", "_id", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := memory.Delete(nil, "players", "_id", 2); err != ErrNotFound {
+		t.Errorf("got %v deleting a missing document, want ErrNotFound", err)
+	}
+	if n, err := memory.Count("players"); err != nil || n != 1 {
+		t.Errorf("got %d, %v counting, want 1", n, err)
+	}
+
+	if err := memory.Drop("players"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := memory.Count("players"); err != nil || n != 0 {
+		t.Errorf("got %d, %v counting a dropped collection, want 0", n, err)
+	}
+}
+
+func TestList(t *testing.T) {
+	memory := New()
+	for _, id := range []int{1, 2, 3, 4} {
+		if err := memory.Create(&player{Id: id, Age: 20 + id}, "players"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name  string
+		query interface{}
+		limit int
+		want  []int
+	}{
+		{"all", nil, 0, []int{1, 2, 3, 4}},
+		{"limit", nil, 2, []int{1, 2}},
+		{"query", bson.M{"age": bson.M{"$gte": 23}}, 0, []int{3, 4}},
+		{"query and limit", bson.M{"age": bson.M{"$gte": 22}}, 1, []int{2}},
+	}
+	for _, test := range tests {
+		players := []player{}
+		if err := memory.List(&players, "players", test.query, test.limit); err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		ids := []int{}
+		for _, p := range players {
+			ids = append(ids, p.Id)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, ids, test.want)
+		}
+	}
+}
@@ -21,11 +21,20 @@
 package mongodb
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/greivinlopez/skue"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
 	"strings"
+	"time"
 )
 
 var (
@@ -34,11 +43,91 @@ var (
 
 var ErrNotFound = mgo.ErrNotFound
 
+// driverError is an error of the MongoDB driver classified as one of the
+// skue errors. Both errors can be checked with errors.Is.
+type driverError struct {
+	kind error
+	err  error
+}
+
+func (e *driverError) Error() string {
+	return e.err.Error()
+}
+
+func (e *driverError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// classify wraps the errors of the MongoDB driver with the skue error that
+// describes them so the persistence utils can report the right HTTP status.
+func classify(err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case err == mgo.ErrNotFound:
+		return &driverError{skue.ErrNotFound, err}
+	case mgo.IsDup(err):
+		return &driverError{skue.ErrConflict, err}
+	case err == io.EOF || errors.As(err, &netErr):
+		return &driverError{skue.ErrUnavailable, err}
+	}
+	return err
+}
+
 type MongoDBPersistor struct {
 	address  string
 	username string
 	password string
 	database string
+
+	// Timeout limits the operations whose context has no deadline, 30
+	// seconds by default.
+	Timeout time.Duration
+	// ReadOptions protects the database from cache stampedes, see Read.
+	ReadOptions ReadOptions
+	// ErrorLog logs the errors that are not returned, like the cache errors
+	// after a document is written. The standard logger is used when it is
+	// nil.
+	ErrorLog *log.Logger
+	flights  flightGroup
+
+	// queries, if not nil, replaces the queries of single documents so the
+	// tests can run with no MongoDB server.
+	queries documentQueries
+}
+
+// documentQueries reads and creates single documents in the database.
+type documentQueries interface {
+	findOne(ctx context.Context, document interface{}, collection string, idfield string, id interface{}) error
+	insert(ctx context.Context, document interface{}, collection string) error
+}
+
+// mgoQueries runs the queries of single documents on the MongoDB server.
+type mgoQueries struct {
+	mongo *MongoDBPersistor
+}
+
+func (queries mgoQueries) findOne(ctx context.Context, document interface{}, collection string, idfield string, id interface{}) error {
+	mongo := queries.mongo
+	return mongo.runRead(ctx, collection, document, func(c *mgo.Collection, document interface{}) error {
+		query := bson.M{idfield: id}
+		return mongo.withMaxTime(ctx, c.Find(query)).One(document)
+	})
+}
+
+func (queries mgoQueries) insert(ctx context.Context, document interface{}, collection string) error {
+	return queries.mongo.run(ctx, collection, func(c *mgo.Collection) error {
+		return c.Insert(document)
+	})
+}
+
+// documents returns the queries of single documents of the persistor.
+func (mongo *MongoDBPersistor) documents() documentQueries {
+	if mongo.queries != nil {
+		return mongo.queries
+	}
+	return mgoQueries{mongo}
 }
 
 // New creates a new MongoDBPersistor.
@@ -57,6 +146,15 @@ func New(address, username, password, database string) *MongoDBPersistor {
 		database: database}
 }
 
+// logf logs an error of the persistor that is not returned.
+func (mongo *MongoDBPersistor) logf(format string, args ...interface{}) {
+	if mongo.ErrorLog != nil {
+		mongo.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
 // GetSession attempts to establish a connection with the server
 func (mongo *MongoDBPersistor) getSession() *mgo.Session {
 	if mgoSession == nil {
@@ -75,25 +173,121 @@ func (mongo *MongoDBPersistor) getSession() *mgo.Session {
 	return mgoSession.Clone()
 }
 
+// timeout returns the time left for an operation given its context: until
+// the deadline of the context, or the Timeout of the persistor.
+func (mongo *MongoDBPersistor) timeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	if mongo.Timeout > 0 {
+		return mongo.Timeout
+	}
+	return 30 * time.Second
+}
+
+// run runs the given operation on the collection with a session of its own,
+// whose socket times out when the time given by the context is over.
+// When the context is done first the session is closed and the error of the
+// context is returned right away. The operation is abandoned then, what it
+// reads into the documents given must not be used.
+func (mongo *MongoDBPersistor) run(ctx context.Context, collection string, operation func(c *mgo.Collection) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timeout := mongo.timeout(ctx)
+	if timeout <= 0 {
+		return context.DeadlineExceeded
+	}
+	session := mongo.getSession()
+	session.SetSocketTimeout(timeout)
+	result := make(chan error, 1)
+	go func() {
+		result <- operation(session.DB(mongo.database).C(collection))
+	}()
+
+	select {
+	case err := <-result:
+		session.Close()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return classify(err)
+	case <-ctx.Done():
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+// runRead runs a read operation like run. The operation decodes into a
+// private value of the type the result points to, which is copied to the
+// result only when the operation succeeds, so an abandoned operation never
+// writes to the values of the caller.
+func (mongo *MongoDBPersistor) runRead(ctx context.Context, collection string, result interface{}, operation func(c *mgo.Collection, result interface{}) error) error {
+	private := reflect.New(reflect.TypeOf(result).Elem())
+	err := mongo.run(ctx, collection, func(c *mgo.Collection) error {
+		return operation(c, private.Interface())
+	})
+	if err == nil {
+		reflect.ValueOf(result).Elem().Set(private.Elem())
+	}
+	return err
+}
+
+// contextDone tells whether the error means the context of the operation is
+// done. The operation could still reach the server then.
+func contextDone(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// forget removes the document of the key from the cache, even if the context
+// is done, so the readers do not get an outdated document.
+func (mongo *MongoDBPersistor) forget(ctx context.Context, cache skue.MemoryCacher, key string) {
+	mongo.flights.invalidate(key)
+	if err := skue.ContextCacher(cache).DeleteContext(context.WithoutCancel(ctx), key); err != nil {
+		mongo.logf("mongodb: removing %s from the cache: %v", key, err)
+	}
+}
+
+// withMaxTime limits the time the server spends running the query to the
+// time given by the context, so slow queries do not pile up on the server.
+func (mongo *MongoDBPersistor) withMaxTime(ctx context.Context, query *mgo.Query) *mgo.Query {
+	if timeout := mongo.timeout(ctx); timeout > 0 {
+		query.SetMaxTime(timeout)
+	}
+	return query
+}
+
 // Drop removes all the elements from the given collection
 func (mongo *MongoDBPersistor) Drop(collectionName string) (err error) {
-	session := mongo.getSession()
-	defer session.Close()
+	return mongo.DropContext(context.Background(), collectionName)
+}
 
-	c := session.DB(mongo.database).C(collectionName)
-	_, err = c.RemoveAll(nil)
-	return
+// DropContext removes all the elements from the given collection, giving up
+// when the context is done.
+func (mongo *MongoDBPersistor) DropContext(ctx context.Context, collectionName string) (err error) {
+	return mongo.run(ctx, collectionName, func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(nil)
+		return err
+	})
 }
 
 // Count returns the number of elements of the given collection
 func (mongo *MongoDBPersistor) Count(collectionName string) (n int, err error) {
-	// Create MongoDB session
-	session := mongo.getSession()
-	defer session.Close()
+	return mongo.CountContext(context.Background(), collectionName)
+}
 
-	c := session.DB(mongo.database).C(collectionName)
-	n, err = c.Count()
-	return
+// CountContext returns the number of elements of the given collection, giving
+// up when the context is done.
+func (mongo *MongoDBPersistor) CountContext(ctx context.Context, collectionName string) (n int, err error) {
+	count := 0
+	err = mongo.run(ctx, collectionName, func(c *mgo.Collection) (err error) {
+		count, err = c.Count()
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
 }
 
 // DropIndexes removes the indexes from the given collection
@@ -116,121 +310,488 @@ func (mongo *MongoDBPersistor) DropIndexes(collection *mgo.Collection) (err erro
 
 // Create saves the given document into the provided collection
 func (mongo *MongoDBPersistor) Create(document interface{}, collection string) (err error) {
-	session := mongo.getSession()
-	defer session.Close()
+	return mongo.CreateContext(context.Background(), document, collection)
+}
 
-	c := session.DB(mongo.database).C(collection)
-	err = c.Insert(document)
-	return
+// CreateContext saves the given document into the provided collection,
+// giving up when the context is done.
+func (mongo *MongoDBPersistor) CreateContext(ctx context.Context, document interface{}, collection string) (err error) {
+	return mongo.documents().insert(ctx, document, collection)
 }
 
-// Gets a string key to use on cache systems
-func getKey(collection string, id interface{}) (key string, err error) {
+// CreateWithCache saves the given document into the provided collection, and
+// removes it from the documents cached as not found by the given cache.
+func (mongo *MongoDBPersistor) CreateWithCache(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	return mongo.CreateWithCacheContext(context.Background(), cache, document, collection, idfield, id)
+}
+
+// CreateWithCacheContext saves the given document into the provided
+// collection like CreateWithCache, giving up when the context is done.
+// Once the document is saved the errors of the cache are logged, not
+// returned, since the document was created anyway, and the cache is updated
+// even if the context is done.
+func (mongo *MongoDBPersistor) CreateWithCacheContext(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	key := CacheKey(collection, id)
+	err = mongo.CreateContext(ctx, document, collection)
+	// The document could still be created after the context is done
+	if err != nil && !contextDone(err) {
+		return err
+	}
+
+	// Forget the document was not found if needed
+	if _, ok := cache.(skue.ExpiringCacher); ok && mongo.ReadOptions.NotFoundTTL > 0 {
+		mongo.flights.invalidate(key)
+		cacheErr := skue.ContextCacher(cache).DeleteContext(context.WithoutCancel(ctx), notFoundKey(key))
+		if cacheErr != nil {
+			mongo.logf("mongodb: forgetting %s was not found: %v", key, cacheErr)
+		}
+	}
+	return err
+}
+
+// CacheKey returns the string key of the given document on cache systems,
+// ids other than strings and object ids are formatted with fmt.Sprint.
+// Other persistors use it to share the cached documents.
+func CacheKey(collection string, id interface{}) string {
 	switch v := id.(type) {
 	case string:
-		return collection + "-" + v, nil
+		return collection + "-" + v
 	case bson.ObjectId:
-		return collection + "-" + v.Hex(), nil
-	default:
-		return "", errors.New("Unrecognized type for cache key")
+		return collection + "-" + v.Hex()
 	}
-	return "", errors.New("Unrecognized type for cache key")
+	return collection + "-" + fmt.Sprint(id)
 }
 
 // Gets a list of documents from the given collection
 func (mongo *MongoDBPersistor) List(documents interface{}, collection string, query interface{}, limit int) (err error) {
-	session := mongo.getSession()
-	defer session.Close()
+	return mongo.ListContext(context.Background(), documents, collection, query, limit)
+}
 
-	c := session.DB(mongo.database).C(collection)
+// ListContext gets a list of documents from the given collection, giving up
+// when the context is done.
+func (mongo *MongoDBPersistor) ListContext(ctx context.Context, documents interface{}, collection string, query interface{}, limit int) (err error) {
+	return mongo.runRead(ctx, collection, documents, func(c *mgo.Collection, documents interface{}) error {
+		return mongo.withMaxTime(ctx, c.Find(query).Limit(limit)).All(documents)
+	})
+}
 
-	err = c.Find(query).Limit(limit).All(documents)
-	return
+// encodeCursor returns an opaque cursor pointing to the given id. The page
+// of the cursor starts right after the id, or ends right before it when
+// before is true.
+func encodeCursor(id interface{}, before bool) (string, error) {
+	value := bson.M{"id": id}
+	if before {
+		value["before"] = true
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
 }
 
-// Read retrieves the document associated with the given collection+id trying the given
-// memory cache first.
-func (mongo *MongoDBPersistor) Read(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
-	// Checking cache first
-	key, err := getKey(collection, id)
+// decodeCursor returns the id a cursor points to and whether its page ends
+// right before it.
+func decodeCursor(cursor string) (id interface{}, before bool, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	value := bson.M{}
+	if err == nil {
+		err = bson.Unmarshal(data, &value)
+	}
+	if err != nil || value["id"] == nil {
+		return nil, false, skue.NewProblem(http.StatusBadRequest, "Invalid cursor")
+	}
+	before, _ = value["before"].(bool)
+	return value["id"], before, nil
+}
+
+// documentCursor returns the cursor pointing to the document at the given
+// index of the documents.
+func documentCursor(documents reflect.Value, index int, idfield string, before bool) (string, error) {
+	data, err := bson.Marshal(documents.Index(index).Interface())
 	if err != nil {
-		return err
+		return "", err
+	}
+	document := bson.M{}
+	if err = bson.Unmarshal(data, &document); err != nil {
+		return "", err
 	}
+	return encodeCursor(document[idfield], before)
+}
 
-	if cache != nil {
-		err = cache.Get(key, document)
-		if err == nil {
+// Filter translates the conditions of the query to a MongoDB query document.
+// Returns nil if the query has no conditions.
+func Filter(query skue.Query) bson.M {
+	if len(query.Conditions) == 0 {
+		return nil
+	}
+	conditions := []interface{}{}
+	for _, condition := range query.Conditions {
+		var value interface{} = condition.Value
+		if condition.Operator != skue.OpEqual {
+			value = bson.M{"$" + condition.Operator: condition.Value}
+		}
+		conditions = append(conditions, bson.M{condition.Field: value})
+	}
+	return and(conditions)
+}
+
+// Sort translates the sort fields of the query to the fields expected by
+// the Sort method of mgo queries.
+func Sort(query skue.Query) []string {
+	fields := []string{}
+	for _, field := range query.Sort {
+		if field.Descending {
+			fields = append(fields, "-"+field.Field)
+		} else {
+			fields = append(fields, field.Field)
+		}
+	}
+	return fields
+}
+
+// contains reports whether the list of strings contains the given value.
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// and joins the given MongoDB query documents.
+func and(conditions []interface{}) bson.M {
+	switch len(conditions) {
+	case 0:
+		return nil
+	case 1:
+		if condition, ok := conditions[0].(bson.M); ok {
+			return condition
+		}
+	}
+	return bson.M{"$and": conditions}
+}
+
+// BSONKey returns the key of the struct field in the MongoDB documents: ""
+// for inlined fields and "-" for the fields that are not stored. Other
+// persistors use it to store the documents just like MongoDB does.
+func BSONKey(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("bson"), ",")
+	for _, flag := range tag[1:] {
+		if flag == "inline" {
+			return ""
+		}
+	}
+	if tag[0] != "" {
+		return tag[0]
+	}
+	return strings.ToLower(field.Name)
+}
+
+// bsonPath translates a path of fields as named by the clients to the path of
+// keys in the MongoDB documents of the given type.
+func bsonPath(t reflect.Type, path string) (string, bool) {
+	keys := []string{}
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return "", false
+		}
+		found := false
+		for _, field := range skue.ClientFields(t) {
+			if !strings.EqualFold(skue.FieldName(field), name) {
+				continue
+			}
+			// Embedded structs are subdocuments unless they are inlined
+			for i := range field.Index {
+				step := t.FieldByIndex(field.Index[:i+1])
+				key := BSONKey(step)
+				if key == "-" || (key == "" && !step.Anonymous) {
+					return "", false
+				} else if key != "" {
+					keys = append(keys, key)
+				}
+			}
+			t = field.Type
+			found = true
+			break
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return strings.Join(keys, "."), true
+}
+
+// projection translates the fields requested by the client to a MongoDB
+// projection for the documents of the given type. Returns nil, to fetch the
+// whole documents, when any of the fields can not be translated.
+func projection(t reflect.Type, fields []string, idfield string) bson.M {
+	if len(fields) == 0 {
+		return nil
+	}
+	keys := []string{idfield}
+	for _, field := range fields {
+		key, ok := bsonPath(t, field)
+		if !ok {
 			return nil
 		}
+		keys = append(keys, key)
+	}
+	result := bson.M{}
+	for _, key := range keys {
+		// MongoDB does not allow a key and one of its children in the
+		// same projection
+		covered := false
+		for _, other := range keys {
+			if strings.HasPrefix(key, other+".") {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			result[key] = 1
+		}
 	}
+	return result
+}
 
-	session := mongo.getSession()
-	defer session.Close()
+// PageQuery is the query of a page of documents requested with a
+// ListRequest. Other persistors use it to page their documents just like the
+// MongoDBPersistor does.
+type PageQuery struct {
+	Query bson.M   // Selects the documents of the page, after the cursor if any
+	Sort  []string // Sort fields as expected by mgo, the id field included
+	Count bool     // Tells whether the total number of documents is needed
+
+	idfield string
+	keyset  bool
+	before  bool // Tells whether the page ends right before the cursor
+	request skue.ListRequest
+}
 
-	c := session.DB(mongo.database).C(collection)
-	query := bson.M{idfield: id}
+// NewPageQuery returns the query of the page of documents of the given
+// request, joined with the given query. Cursors only work when the documents
+// are sorted by the id field, they are rejected with a "400 Bad Request"
+// problem otherwise. The documents of the pages ending before a cursor are
+// read in descending order of the id field, see Page.
+func NewPageQuery(query interface{}, idfield string, request skue.ListRequest) (*PageQuery, error) {
+	conditions := []interface{}{}
+	if query != nil {
+		conditions = append(conditions, query)
+	}
+	if filter := Filter(request.Query); filter != nil {
+		conditions = append(conditions, filter)
+	}
+	sorting := Sort(request.Query)
+	// Cursors point to a value of the id field so they only work when the
+	// documents are sorted by it.
+	keyset := len(sorting) == 0
+	if !contains(sorting, idfield) && !contains(sorting, "-"+idfield) {
+		sorting = append(sorting, idfield)
+	}
 
-	err = c.Find(query).One(document)
+	before := false
+	if request.Cursor != "" {
+		if !keyset {
+			return nil, skue.NewProblem(http.StatusBadRequest, "Cursors can not be used with sorted lists")
+		}
+		var id interface{}
+		var err error
+		id, before, err = decodeCursor(request.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if before {
+			conditions = append(conditions, bson.M{idfield: bson.M{"$lt": id}})
+			sorting = []string{"-" + idfield}
+		} else {
+			conditions = append(conditions, bson.M{idfield: bson.M{"$gt": id}})
+		}
+	}
+	return &PageQuery{
+		Query:   and(conditions),
+		Sort:    sorting,
+		Count:   request.Cursor == "",
+		idfield: idfield,
+		keyset:  keyset,
+		before:  before,
+		request: request,
+	}, nil
+}
 
+// Page returns the page of the documents read for the query, a pointer to a
+// slice, given the total number of documents when it is counted. The
+// documents of a page ending before a cursor are put back in ascending order.
+// The pages read with a cursor link to the previous page, and the pages
+// holding as many documents as requested link to the next one.
+func (query *PageQuery) Page(documents interface{}, total int) (page *skue.Page, err error) {
+	page = &skue.Page{Total: -1}
+	if query.Count {
+		page.Total = total
+	}
+	results := reflect.ValueOf(documents).Elem()
+	if query.before {
+		swap := reflect.Swapper(results.Interface())
+		for i, j := 0, results.Len()-1; i < j; i, j = i+1, j-1 {
+			swap(i, j)
+		}
+	}
+	page.Items = results.Interface()
+	if !query.keyset || query.request.Offset != 0 || results.Len() == 0 {
+		return
+	}
+	full := results.Len() == query.request.Limit
+	if query.before || (full && results.Len() != page.Total) {
+		page.NextCursor, err = documentCursor(results, results.Len()-1, query.idfield, false)
+	}
+	if err == nil && query.request.Cursor != "" && (full || !query.before) {
+		page.PrevCursor, err = documentCursor(results, 0, query.idfield, true)
+	}
+	return
+}
+
+// ListPage gets a page of documents from the given collection.
+// The documents parameter must be a pointer to a slice.
+// The query is joined with the query of the request, and the documents are
+// sorted as requested and then by the id field to get stable pages.
+// Only the fields requested by the client are fetched when possible.
+// When the documents are only sorted by the id field the first page and the
+// pages requested with a cursor include the cursor to the next page, and the
+// pages requested with a cursor the cursor to the previous one too. Pages
+// requested by offset include the total number of documents.
+func (mongo *MongoDBPersistor) ListPage(documents interface{}, collection string, query interface{}, idfield string, request skue.ListRequest) (page *skue.Page, err error) {
+	return mongo.ListPageContext(context.Background(), documents, collection, query, idfield, request)
+}
+
+// ListPageContext gets a page of documents from the given collection like
+// ListPage, giving up when the context is done.
+func (mongo *MongoDBPersistor) ListPageContext(ctx context.Context, documents interface{}, collection string, query interface{}, idfield string, request skue.ListRequest) (page *skue.Page, err error) {
+	pageQuery, err := NewPageQuery(query, idfield, request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Save the value to cache if needed
+	total := 0
+	fields := projection(reflect.TypeOf(documents), request.Fields, idfield)
+	err = mongo.runRead(ctx, collection, documents, func(c *mgo.Collection, documents interface{}) (err error) {
+		if pageQuery.Count {
+			total, err = mongo.withMaxTime(ctx, c.Find(pageQuery.Query)).Count()
+			if err != nil {
+				return err
+			}
+		}
+		return mongo.withMaxTime(ctx, c.Find(pageQuery.Query).Select(fields).Sort(pageQuery.Sort...).Skip(request.Offset).Limit(request.Limit)).All(documents)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageQuery.Page(documents, total)
+}
+
+// Read retrieves the document associated with the given collection+id trying the given
+// memory cache first.
+// Concurrent reads of a document missing from the cache share one read from
+// the database, see ReadOptions for the other protections against stampedes.
+func (mongo *MongoDBPersistor) Read(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	return mongo.ReadContext(context.Background(), cache, document, collection, idfield, id)
+}
+
+// ReadContext retrieves the document associated with the given collection+id
+// trying the given memory cache first, giving up when the context is done.
+// The cache is not used when the context asks to bypass it, see
+// skue.WithoutCache.
+func (mongo *MongoDBPersistor) ReadContext(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	if skue.CacheBypassed(ctx) {
+		cache = nil
+	}
+	// Checking cache first
+	key := CacheKey(collection, id)
 	if cache != nil {
-		err = cache.Set(key, document)
-		return err
+		var ttl time.Duration
+		ttl, err = mongo.getCached(ctx, cache, key, document)
+		if err == nil {
+			if mongo.ReadOptions.refreshEarly(ttl) {
+				mongo.refresh(cache, document, collection, idfield, id, key)
+			}
+			return nil
+		}
+		// The document is read from the database and cached again, unless
+		// the cache told it is unavailable
+		if errors.Is(err, skue.ErrUnavailable) {
+			cache = nil
+		} else if mongo.cachedNotFound(ctx, cache, key) {
+			return classify(mgo.ErrNotFound)
+		}
 	}
-	return nil
+
+	return mongo.fetch(ctx, cache, document, collection, idfield, id, key)
 }
 
 // Update changes the given document on the database (and the given cache if not nil)
 func (mongo *MongoDBPersistor) Update(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
-	session := mongo.getSession()
-	defer session.Close()
-
-	c := session.DB(mongo.database).C(collection)
-	query := bson.M{idfield: id}
+	return mongo.UpdateContext(context.Background(), cache, document, collection, idfield, id)
+}
 
-	err = c.Update(query, document)
+// UpdateContext changes the given document on the database (and the given
+// cache if not nil), giving up when the context is done. Once the document
+// is changed the errors of the cache are logged, not returned, and the cache
+// is updated even if the context is done. When the context is done first the
+// document is removed from the cache, since it could be changed anyway.
+func (mongo *MongoDBPersistor) UpdateContext(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}) (err error) {
+	err = mongo.run(ctx, collection, func(c *mgo.Collection) error {
+		query := bson.M{idfield: id}
+		return c.Update(query, document)
+	})
 	if err != nil {
+		// The document could still be changed after the context is done
+		if cache != nil && contextDone(err) {
+			mongo.forget(ctx, cache, CacheKey(collection, id))
+		}
 		return err
 	}
 
 	// Save the value to cache if needed
 	if cache != nil {
-		key, err := getKey(collection, id)
-		if err != nil {
-			return err
+		key := CacheKey(collection, id)
+		mongo.flights.invalidate(key)
+		if err = skue.ContextCacher(cache).SetContext(context.WithoutCancel(ctx), key, document); err != nil {
+			mongo.logf("mongodb: caching %s: %v", key, err)
 		}
-		err = cache.Set(key, document)
 	}
-	return
+	return nil
 }
 
 // Delete removes the document associated with the given collection+id from the database
 // and from the cache system given if any.
 func (mongo *MongoDBPersistor) Delete(cache skue.MemoryCacher, collection string, idfield string, id interface{}) (err error) {
-	session := mongo.getSession()
-	defer session.Close()
-
-	c := session.DB(mongo.database).C(collection)
-	query := bson.M{idfield: id}
+	return mongo.DeleteContext(context.Background(), cache, collection, idfield, id)
+}
 
-	err = c.Remove(query)
-	if err != nil {
+// DeleteContext removes the document associated with the given collection+id
+// from the database and from the cache system given if any, giving up when
+// the context is done. Once the document is removed the errors of the cache
+// are logged, not returned, and the cache is updated even if the context is
+// done, also when it is done first since the document could be removed
+// anyway.
+func (mongo *MongoDBPersistor) DeleteContext(ctx context.Context, cache skue.MemoryCacher, collection string, idfield string, id interface{}) (err error) {
+	err = mongo.run(ctx, collection, func(c *mgo.Collection) error {
+		query := bson.M{idfield: id}
+		return c.Remove(query)
+	})
+	// The document could still be removed after the context is done
+	if err != nil && !contextDone(err) {
 		return err
 	}
 
 	// Delete the value from cache if needed
 	if cache != nil {
-		key, err := getKey(collection, id)
-		if err != nil {
-			return err
-		}
-		err = cache.Delete(key)
+		mongo.forget(ctx, cache, CacheKey(collection, id))
 	}
-	return
+	return err
 }
 
 // ----------------------------------------------------------------------------
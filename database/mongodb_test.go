@@ -0,0 +1,420 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/greivinlopez/skue"
+	"github.com/greivinlopez/skue/cache/lru"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type audit struct {
+	Created string `json:"created" bson:"created"`
+}
+
+type person struct {
+	Country string `json:"country" bson:"country"`
+}
+
+type player struct {
+	audit
+	person `bson:",inline"`
+	Name   string `json:"name" bson:"name"`
+	Secret string `json:"secret" bson:"-"`
+}
+
+func TestBsonPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"name", "name", true},
+		{"Name", "name", true},
+		{"created", "audit.created", true},
+		{"country", "country", true},
+		{"secret", "", false},
+		{"unknown", "", false},
+		{"name.first", "", false},
+	}
+	for _, test := range tests {
+		path, ok := bsonPath(reflect.TypeOf(player{}), test.path)
+		if path != test.want || ok != test.ok {
+			t.Errorf("bsonPath(%q) = %q, %v, want %q, %v", test.path, path, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	other := errors.New("bad query")
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{"not found", mgo.ErrNotFound, skue.ErrNotFound},
+		{"duplicate", &mgo.LastError{Code: 11000, Err: "duplicate key"}, skue.ErrConflict},
+		{"connection closed", io.EOF, skue.ErrUnavailable},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, skue.ErrUnavailable},
+		{"other", other, nil},
+	}
+	for _, test := range tests {
+		err := classify(test.err)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want it to wrap %v", test.name, err, test.err)
+		}
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("%s: got %v, want it to match %v", test.name, err, test.kind)
+		} else if test.kind == nil && err != test.err {
+			t.Errorf("%s: got %v, want it unchanged", test.name, err)
+		}
+	}
+	if classify(nil) != nil {
+		t.Errorf("got an error for nil")
+	}
+}
+
+// The reads are tested with a fake database, replacing the queries of the
+// persistor, and a cache kept in memory.
+
+type team struct {
+	Id   string `bson:"_id"`
+	Name string `bson:"name"`
+}
+
+// fakeDB is the documentQueries of the persistor, keeping the teams it
+// reads and the other documents inserted. Reads wait for the release channel
+// when it is not nil.
+type fakeDB struct {
+	mutex    sync.Mutex
+	teams    map[string]team
+	inserted []interface{}
+	reads    int
+	release  chan struct{}
+	started  chan struct{}
+}
+
+func (db *fakeDB) findOne(ctx context.Context, document interface{}, collection string, idfield string, id interface{}) error {
+	db.mutex.Lock()
+	db.reads++
+	release, started := db.release, db.started
+	db.mutex.Unlock()
+	if started != nil {
+		started <- struct{}{}
+	}
+	if release != nil {
+		<-release
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	found, ok := db.teams[id.(string)]
+	if !ok {
+		return classify(mgo.ErrNotFound)
+	}
+	*document.(*team) = found
+	return nil
+}
+
+func (db *fakeDB) insert(ctx context.Context, document interface{}, collection string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if created, ok := document.(*team); ok {
+		db.teams[created.Id] = *created
+	} else {
+		db.inserted = append(db.inserted, document)
+	}
+	return nil
+}
+
+func (db *fakeDB) readCount() int {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.reads
+}
+
+// newFakePersistor creates a persistor reading the teams of the fake
+// database.
+func newFakePersistor(teams ...team) (*MongoDBPersistor, *fakeDB) {
+	db := &fakeDB{teams: map[string]team{}}
+	for _, t := range teams {
+		db.teams[t.Id] = t
+	}
+	mongo := New("", "", "", "")
+	mongo.ErrorLog = log.New(io.Discard, "", 0)
+	mongo.queries = db
+	return mongo, db
+}
+
+// waiters returns the number of readers waiting for the flight of the key.
+func waiters(mongo *MongoDBPersistor, key string) int {
+	mongo.flights.mutex.Lock()
+	defer mongo.flights.mutex.Unlock()
+	if current, ok := mongo.flights.flights[key]; ok {
+		return current.waiters
+	}
+	return 0
+}
+
+// fakeLocker is a skue.Locker always held by someone else.
+type fakeLocker struct {
+	mutex sync.Mutex
+	locks int
+}
+
+func (locker *fakeLocker) Lock(ctx context.Context, key string, ttl time.Duration) (func() error, error) {
+	locker.mutex.Lock()
+	defer locker.mutex.Unlock()
+	locker.locks++
+	return nil, skue.ErrLocked
+}
+
+func TestReadCoalesces(t *testing.T) {
+	mongo, db := newFakePersistor(team{"1", "Saprissa"})
+	db.release = make(chan struct{})
+	cache := lru.New(lru.Options{})
+	key := CacheKey("teams", "1")
+
+	const readers = 10
+	results := make(chan error, readers)
+	found := make([]team, readers)
+	for i := 0; i < readers; i++ {
+		go func(i int) {
+			results <- mongo.Read(cache, &found[i], "teams", "_id", "1")
+		}(i)
+	}
+	for waiters(mongo, key) < readers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(db.release)
+	for i := 0; i < readers; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if reads := db.readCount(); reads != 1 {
+		t.Errorf("got %d reads from the database, want 1", reads)
+	}
+	for i, got := range found {
+		if got.Name != "Saprissa" {
+			t.Errorf("reader %d got %+v, want Saprissa", i, got)
+		}
+	}
+	cached := team{}
+	if err := cache.Get(key, &cached); err != nil || cached.Name != "Saprissa" {
+		t.Errorf("got %+v cached with error %v, want Saprissa", cached, err)
+	}
+}
+
+func TestReadStaleFlight(t *testing.T) {
+	mongo, db := newFakePersistor(team{"1", "Saprissa"})
+	db.release = make(chan struct{})
+	db.started = make(chan struct{}, 1)
+	cache := lru.New(lru.Options{})
+	key := CacheKey("teams", "1")
+
+	result := make(chan error, 1)
+	go func() {
+		result <- mongo.Read(cache, &team{}, "teams", "_id", "1")
+	}()
+	<-db.started
+	// The document is written while it is read, like UpdateContext does
+	mongo.flights.invalidate(key)
+	close(db.release)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Get(key, &team{}); !errors.Is(err, skue.ErrCacheMiss) {
+		t.Errorf("got %v reading the cache, want the stale document not cached", err)
+	}
+	if _, leader := mongo.flights.start(key, false); !leader {
+		t.Error("the stale flight is still shared with new readers")
+	}
+}
+
+func TestReadLocked(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		mongo, db := newFakePersistor(team{"1", "Saprissa"})
+		locker := &fakeLocker{}
+		mongo.ReadOptions = ReadOptions{Locker: locker, RefreshTimeout: 50 * time.Millisecond}
+		cache := lru.New(lru.Options{})
+
+		found := team{}
+		if err := mongo.Read(cache, &found, "teams", "_id", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if found.Name != "Saprissa" || db.readCount() != 1 {
+			t.Errorf("got %+v with %d reads, want Saprissa read from the database", found, db.readCount())
+		}
+		if locker.locks < 2 {
+			t.Errorf("got %d tries to lock, want the lock polled", locker.locks)
+		}
+	})
+
+	t.Run("cached by another instance", func(t *testing.T) {
+		mongo, db := newFakePersistor(team{"1", "Saprissa"})
+		mongo.ReadOptions = ReadOptions{Locker: &fakeLocker{}, RefreshTimeout: time.Minute}
+		cache := lru.New(lru.Options{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cache.Set(CacheKey("teams", "1"), team{"1", "Alajuelense"})
+		}()
+
+		found := team{}
+		if err := mongo.Read(cache, &found, "teams", "_id", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if found.Name != "Alajuelense" || db.readCount() != 0 {
+			t.Errorf("got %+v with %d reads, want the cached team and no reads", found, db.readCount())
+		}
+	})
+}
+
+func TestRefreshEarly(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ReadOptions
+		ttl     time.Duration
+		want    bool
+	}{
+		{"disabled", ReadOptions{}, 0, false},
+		{"no expiration", ReadOptions{EarlyRefresh: time.Minute}, -1, false},
+		{"expired", ReadOptions{EarlyRefresh: time.Minute}, 0, true},
+		{"far from expiring", ReadOptions{EarlyRefresh: time.Second}, time.Hour, false},
+	}
+	for _, test := range tests {
+		if got := test.options.refreshEarly(test.ttl); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	mongo, db := newFakePersistor(team{"1", "Alajuelense"})
+	mongo.ReadOptions = ReadOptions{EarlyRefresh: 365 * 24 * time.Hour}
+	cache := lru.New(lru.Options{})
+	key := CacheKey("teams", "1")
+	cache.SetWithTTL(key, team{"1", "Saprissa"}, time.Minute)
+
+	found := team{}
+	if err := mongo.Read(cache, &found, "teams", "_id", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Saprissa" {
+		t.Errorf("got %+v, want the cached team while it is refreshed", found)
+	}
+	deadline := time.Now().Add(time.Second)
+	for cache.Get(key, &found); found.Name != "Alajuelense"; cache.Get(key, &found) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %+v cached, want the team refreshed in the background", found)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if reads := db.readCount(); reads != 1 {
+		t.Errorf("got %d reads from the database, want 1", reads)
+	}
+}
+
+func TestReadNotFound(t *testing.T) {
+	mongo, db := newFakePersistor()
+	mongo.ReadOptions = ReadOptions{NotFoundTTL: 50 * time.Millisecond}
+	cache := lru.New(lru.Options{})
+
+	for i := 0; i < 2; i++ {
+		if err := mongo.Read(cache, &team{}, "teams", "_id", "1"); !errors.Is(err, skue.ErrNotFound) {
+			t.Fatalf("got %v, want skue.ErrNotFound", err)
+		}
+	}
+	if reads := db.readCount(); reads != 1 {
+		t.Errorf("got %d reads from the database, want the second read from the cache", reads)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := mongo.Read(cache, &team{}, "teams", "_id", "1"); !errors.Is(err, skue.ErrNotFound) {
+		t.Fatalf("got %v, want skue.ErrNotFound", err)
+	}
+	if reads := db.readCount(); reads != 2 {
+		t.Errorf("got %d reads from the database, want another read once the TTL is over", reads)
+	}
+
+	if err := mongo.CreateWithCache(cache, &team{"1", "Saprissa"}, "teams", "_id", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Get(notFoundKey(CacheKey("teams", "1")), new(string)); !errors.Is(err, skue.ErrCacheMiss) {
+		t.Errorf("got %v reading the not found key, want it removed", err)
+	}
+	found := team{}
+	if err := mongo.Read(cache, &found, "teams", "_id", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Saprissa" {
+		t.Errorf("got %+v, want the created team", found)
+	}
+}
+
+func TestReadNotFoundDisabled(t *testing.T) {
+	mongo, db := newFakePersistor()
+	cache := lru.New(lru.Options{})
+	for i := 0; i < 2; i++ {
+		if err := mongo.Read(cache, &team{}, "teams", "_id", "1"); !errors.Is(err, skue.ErrNotFound) {
+			t.Fatalf("got %v, want skue.ErrNotFound", err)
+		}
+	}
+	if reads := db.readCount(); reads != 2 {
+		t.Errorf("got %d reads from the database, want 2 without NotFoundTTL", reads)
+	}
+}
+
+type coach struct {
+	Id   bson.ObjectId `bson:"_id" skue:"id"`
+	Name string        `bson:"name"`
+}
+
+func TestStoreCreate(t *testing.T) {
+	mongo, db := newFakePersistor()
+	store := NewStore[coach, bson.ObjectId](mongo, "coaches", nil)
+	created := &coach{Name: "Alexandre Guimarães"}
+	if err := store.Create(context.Background(), created); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !created.Id.Valid() {
+		t.Errorf("got id %q, want a new ObjectId", created.Id)
+	}
+	if len(db.inserted) != 1 || db.inserted[0].(*coach).Id != created.Id {
+		t.Errorf("got %v inserted, want the coach with its new id", db.inserted)
+	}
+
+	given := &coach{Id: bson.NewObjectId(), Name: "Jeaustin Campos"}
+	store.Create(context.Background(), given)
+	if len(db.inserted) != 2 || db.inserted[1].(*coach).Id != given.Id {
+		t.Errorf("got %v inserted, want the coach with the id given", db.inserted)
+	}
+}
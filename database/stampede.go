@@ -0,0 +1,332 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"github.com/greivinlopez/skue"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// CACHE STAMPEDES
+//
+// When a popular document expires from the cache every reader misses it and
+// reads it from the database at the same time. The persistor coalesces the
+// reads of the same document within the process, and it can lock the reads
+// among the instances of the API and refresh the documents before they
+// expire.
+
+// ReadOptions sets how the persistor protects the database from cache
+// stampedes. Concurrent reads of the same document are always coalesced
+// within the process.
+type ReadOptions struct {
+	// Locker, if not nil, lets only one instance of the API read a missing
+	// document from the database, the others wait for it to be cached.
+	Locker skue.Locker
+	// EarlyRefresh, if not zero, lets the readers refresh a cached document
+	// in the background before it expires while it is still served from the
+	// cache. The closer to the expiration the more likely a reader refreshes
+	// it, it is likely within the last EarlyRefresh of the time to live.
+	// The cache must be a skue.ExpiringCacher.
+	EarlyRefresh time.Duration
+	// RefreshTimeout limits the background refreshes, the time the locks
+	// are held and the time waiting for other instances, 5 seconds by default.
+	RefreshTimeout time.Duration
+	// NotFoundTTL, if not zero, caches the documents not found for this time
+	// so reading them again does not reach the database. It should be short,
+	// and the cache must be a skue.ExpiringCacher. Creating the document with
+	// CreateWithCache removes it from the not found ones.
+	NotFoundTTL time.Duration
+}
+
+// How often the cache is checked while another instance reads the document
+const lockPollInterval = 25 * time.Millisecond
+
+// Value cached for the documents not found
+const notFoundSentinel = "skue:notfound"
+
+// notFoundKey returns the key caching that the document of the given key was
+// not found.
+func notFoundKey(key string) string {
+	return "notfound-" + key
+}
+
+// refreshTimeout returns the timeout of the background refreshes.
+func (options ReadOptions) refreshTimeout() time.Duration {
+	if options.RefreshTimeout > 0 {
+		return options.RefreshTimeout
+	}
+	return 5 * time.Second
+}
+
+// refreshEarly tells whether a cached document with the given time to live
+// must be refreshed. It follows the probabilistic early expiration described
+// in "Optimal Probabilistic Cache Stampede Prevention" by Vattani et al.
+func (options ReadOptions) refreshEarly(ttl time.Duration) bool {
+	if options.EarlyRefresh <= 0 || ttl < 0 {
+		return false
+	}
+	return float64(ttl) <= float64(options.EarlyRefresh)*-math.Log(1-rand.Float64())
+}
+
+// flight is a read of a document shared by concurrent readers. A flight is
+// stale when the document is written while it is read, then the document
+// read is not cached since it may be older than the one written.
+type flight struct {
+	done    chan struct{}
+	waiters int
+	data    []byte // The document encoded as BSON for the waiters
+	err     error
+	mutex   sync.Mutex
+	stale   bool
+}
+
+// flightGroup keeps the reads of the documents in progress by cache key.
+type flightGroup struct {
+	mutex   sync.Mutex
+	flights map[string]*flight
+}
+
+// start returns the flight reading the given key and whether the caller
+// must read the document, which happens when there is no flight yet. Callers
+// waiting for the flight to finish must tell it.
+func (group *flightGroup) start(key string, wait bool) (current *flight, leader bool) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if current, found := group.flights[key]; found {
+		if wait {
+			current.waiters++
+		}
+		return current, false
+	}
+	if group.flights == nil {
+		group.flights = map[string]*flight{}
+	}
+	current = &flight{done: make(chan struct{})}
+	group.flights[key] = current
+	return current, true
+}
+
+// finish shares the document read, or the error, with the waiters of the
+// flight.
+func (group *flightGroup) finish(key string, current *flight, document interface{}, err error) {
+	group.mutex.Lock()
+	if group.flights[key] == current {
+		delete(group.flights, key)
+	}
+	waiters := current.waiters
+	group.mutex.Unlock()
+
+	if err == nil && waiters > 0 {
+		current.data, err = bson.Marshal(document)
+	}
+	current.err = err
+	close(current.done)
+}
+
+// invalidate makes the flight reading the given key stale, if any, so the
+// document it reads is not cached. The next readers start another flight.
+// It must be called after the document is written to the database and
+// before it is written to the cache.
+func (group *flightGroup) invalidate(key string) {
+	group.mutex.Lock()
+	current, found := group.flights[key]
+	if found {
+		delete(group.flights, key)
+	}
+	group.mutex.Unlock()
+
+	if found {
+		// Waits for the flight to finish caching the document if it is
+		current.mutex.Lock()
+		current.stale = true
+		current.mutex.Unlock()
+	}
+}
+
+// cache calls the given function to cache what the flight read, unless the
+// flight is stale.
+func (current *flight) cache(set func() error) error {
+	current.mutex.Lock()
+	defer current.mutex.Unlock()
+	if current.stale {
+		return nil
+	}
+	return set()
+}
+
+// getCached reads the document from the cache, returning its time to live
+// when it is needed to refresh the document early.
+func (mongo *MongoDBPersistor) getCached(ctx context.Context, cache skue.MemoryCacher, key string, document interface{}) (time.Duration, error) {
+	if expiring, ok := cache.(skue.ExpiringCacher); ok && mongo.ReadOptions.EarlyRefresh > 0 {
+		return expiring.GetWithTTLContext(ctx, key, document)
+	}
+	return -1, skue.ContextCacher(cache).GetContext(ctx, key, document)
+}
+
+// cachedNotFound tells whether the document of the key is cached as not
+// found. Only expiring caches are checked, since the documents are cached as
+// not found only with them.
+func (mongo *MongoDBPersistor) cachedNotFound(ctx context.Context, cache skue.MemoryCacher, key string) bool {
+	if _, ok := cache.(skue.ExpiringCacher); !ok || mongo.ReadOptions.NotFoundTTL <= 0 {
+		return false
+	}
+	var value string
+	err := skue.ContextCacher(cache).GetContext(ctx, notFoundKey(key), &value)
+	return err == nil && value == notFoundSentinel
+}
+
+// cacheNotFound caches that the document of the key was not found.
+func (mongo *MongoDBPersistor) cacheNotFound(ctx context.Context, cache skue.MemoryCacher, key string) error {
+	expiring, ok := cache.(skue.ExpiringCacher)
+	if !ok || mongo.ReadOptions.NotFoundTTL <= 0 {
+		return nil
+	}
+	return expiring.SetWithTTLContext(ctx, notFoundKey(key), notFoundSentinel, mongo.ReadOptions.NotFoundTTL)
+}
+
+// fetch reads the document from the database, coalescing the concurrent
+// reads of the same key. The document is cached if the cache is not nil.
+func (mongo *MongoDBPersistor) fetch(ctx context.Context, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}, key string) error {
+	for {
+		current, leader := mongo.flights.start(key, true)
+		if leader {
+			err := mongo.load(ctx, current, cache, document, collection, idfield, id, key)
+			mongo.flights.finish(key, current, document, err)
+			return err
+		}
+
+		select {
+		case <-current.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		// The reader of the flight gave up because of its own context, the
+		// waiters start another flight so only one of them reads the
+		// document
+		if errors.Is(current.err, context.Canceled) || errors.Is(current.err, context.DeadlineExceeded) {
+			continue
+		}
+		if current.err != nil {
+			return current.err
+		}
+		return bson.Unmarshal(current.data, document)
+	}
+}
+
+// refresh reads the document again in the background, unless it is already
+// being read, and caches it.
+func (mongo *MongoDBPersistor) refresh(cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}, key string) {
+	current, leader := mongo.flights.start(key, false)
+	if !leader {
+		return
+	}
+	documentType := reflect.TypeOf(document).Elem()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mongo.ReadOptions.refreshTimeout())
+		defer cancel()
+		fresh := reflect.New(documentType).Interface()
+		err := mongo.load(ctx, current, cache, fresh, collection, idfield, id, key)
+		mongo.flights.finish(key, current, fresh, err)
+	}()
+}
+
+// load reads the document from the database for the given flight and caches
+// it if the cache is not nil and the flight is not stale. With a Locker only
+// one instance of the API reads the document, the others wait for it to be
+// cached.
+func (mongo *MongoDBPersistor) load(ctx context.Context, current *flight, cache skue.MemoryCacher, document interface{}, collection string, idfield string, id interface{}, key string) error {
+	if cache != nil && mongo.ReadOptions.Locker != nil {
+		unlock, done, err := mongo.lock(ctx, cache, key, document)
+		if done {
+			return err
+		}
+		if unlock != nil {
+			defer unlock()
+		}
+	}
+
+	err := mongo.documents().findOne(ctx, document, collection, idfield, id)
+	if errors.Is(err, skue.ErrNotFound) && cache != nil {
+		// The error of the cache is not worth reporting, the document is
+		// just read again from the database next time
+		current.cache(func() error {
+			return mongo.cacheNotFound(ctx, cache, key)
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// Save the value to cache if needed. The document was read anyway, so
+	// the errors of the cache are logged, not returned
+	if cache != nil {
+		err = current.cache(func() error {
+			return skue.ContextCacher(cache).SetContext(ctx, key, document)
+		})
+		if err != nil {
+			mongo.logf("mongodb: caching %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// lock acquires the lock of the key for reading the document. While another
+// instance of the API holds it the cache is checked until that instance
+// caches the document, or caches it as not found, then done is true and err
+// tells which one. The unlock function is nil when the lock could not be
+// acquired, the document is read without it then so an outage of the locker
+// does not take the API down.
+func (mongo *MongoDBPersistor) lock(ctx context.Context, cache skue.MemoryCacher, key string, document interface{}) (unlock func() error, done bool, err error) {
+	timeout := mongo.ReadOptions.refreshTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		unlock, err := mongo.ReadOptions.Locker.Lock(ctx, "lock-"+key, timeout)
+		if !errors.Is(err, skue.ErrLocked) {
+			return unlock, false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false, nil
+		case <-timer.C:
+			return nil, false, nil
+		case <-ticker.C:
+		}
+		if skue.ContextCacher(cache).GetContext(ctx, key, document) == nil {
+			return nil, true, nil
+		}
+		if mongo.cachedNotFound(ctx, cache, key) {
+			return nil, true, classify(mgo.ErrNotFound)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"github.com/greivinlopez/skue"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+)
+
+// Store keeps items of type T in a MongoDB collection, identified by the
+// field of T tagged with skue:"id". It implements skue.Store so items can be
+// served with skue.ModelFactory without writing any persistor.
+// Items with an empty bson.ObjectId id get a new one when created.
+type Store[T any, ID comparable] struct {
+	Persistor  *MongoDBPersistor
+	Collection string
+	Cache      skue.MemoryCacher
+	idfield    string
+}
+
+// NewStore creates a new Store for the given collection. The cache is used
+// to read the items, it could be nil. It panics if T has no id field.
+func NewStore[T any, ID comparable](persistor *MongoDBPersistor, collection string, cache skue.MemoryCacher) *Store[T, ID] {
+	field, ok := skue.IDField(reflect.TypeOf((*T)(nil)))
+	if !ok {
+		panic(fmt.Sprintf("mongodb: %T has no field tagged with skue:\"id\"", *new(T)))
+	}
+	idfield := BSONKey(field)
+	if idfield == "" || idfield == "-" {
+		panic(fmt.Sprintf("mongodb: the id field of %T is not stored with a key of its own", *new(T)))
+	}
+	return &Store[T, ID]{
+		Persistor:  persistor,
+		Collection: collection,
+		Cache:      cache,
+		idfield:    idfield,
+	}
+}
+
+// ParseObjectId translates the ids of the requests to MongoDB ObjectIds, to
+// be used with skue.ModelFactory.
+func ParseObjectId(id string) (bson.ObjectId, error) {
+	if !bson.IsObjectIdHex(id) {
+		return "", skue.ErrNotFound
+	}
+	return bson.ObjectIdHex(id), nil
+}
+
+// ----------------------------------------------------------------------------
+// 			skue.Store implementation
+// ----------------------------------------------------------------------------
+
+func (store *Store[T, ID]) Create(ctx context.Context, item *T) error {
+	if id, ok := skue.ItemID[T, bson.ObjectId](item); ok && id == "" {
+		skue.SetItemID(item, bson.NewObjectId())
+	}
+	id, _ := skue.ItemID[T, ID](item)
+	return store.Persistor.CreateWithCacheContext(ctx, store.Cache, item, store.Collection, store.idfield, id)
+}
+
+func (store *Store[T, ID]) Get(ctx context.Context, id ID) (*T, error) {
+	item := new(T)
+	err := store.Persistor.ReadContext(ctx, store.Cache, item, store.Collection, store.idfield, id)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (store *Store[T, ID]) Update(ctx context.Context, id ID, item *T) error {
+	return store.Persistor.UpdateContext(ctx, store.Cache, item, store.Collection, store.idfield, id)
+}
+
+func (store *Store[T, ID]) Delete(ctx context.Context, id ID) error {
+	return store.Persistor.DeleteContext(ctx, store.Cache, store.Collection, store.idfield, id)
+}
+
+func (store *Store[T, ID]) List(ctx context.Context, request skue.ListRequest) (*skue.PageOf[T], error) {
+	items := []T{}
+	page, err := store.Persistor.ListPageContext(ctx, &items, store.Collection, nil, store.idfield, request)
+	if err != nil {
+		return nil, err
+	}
+	return &skue.PageOf[T]{
+		Items:      items,
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}, nil
+}
@@ -0,0 +1,117 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// ERRORS
+//
+// Persistors should return (or wrap) these errors so the persistence utils
+// can answer with the right HTTP status. Errors are checked with errors.Is so
+// they can be wrapped with any context:
+//
+//    return fmt.Errorf("reading team %s: %w", id, skue.ErrNotFound)
+
+var (
+	// ErrNotFound means the requested item does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict means the operation conflicts with the current state of
+	// the item, like a duplicated key.
+	ErrConflict = errors.New("conflict")
+	// ErrValidationFailed means the item is not valid.
+	ErrValidationFailed = errors.New("validation failed")
+	// ErrForbidden means the operation is not allowed for the client.
+	ErrForbidden = errors.New("forbidden")
+	// ErrPreconditionFailed means a condition given by the client for the
+	// operation is not met.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrUnavailable means the storage is temporarily unable to handle the
+	// operation.
+	ErrUnavailable = errors.New("unavailable")
+	// ErrCacheMiss means the key is not cached. MemoryCachers return it from
+	// Get so persistors can tell a miss from a cache that is not working.
+	ErrCacheMiss = errors.New("cache miss")
+	// ErrLocked means the lock is held by someone else.
+	ErrLocked = errors.New("locked")
+)
+
+// StatusClientClosedRequest is the status, not defined by HTTP, given to the
+// requests whose client went away before the response, like nginx does. The
+// client never gets it, it is only seen by the middlewares and the logs.
+const StatusClientClosedRequest = 499
+
+// StatusCoder is implemented by errors that know the HTTP status they
+// should be reported with.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// errorStatus maps each one of the skue errors to its HTTP status.
+var errorStatus = []struct {
+	err    error
+	status int
+}{
+	{ErrNotFound, http.StatusNotFound},
+	{ErrConflict, http.StatusConflict},
+	{ErrValidationFailed, http.StatusUnprocessableEntity},
+	{ErrForbidden, http.StatusForbidden},
+	{ErrPreconditionFailed, http.StatusPreconditionFailed},
+	{ErrUnavailable, http.StatusServiceUnavailable},
+	{ErrUnsupportedMediaType, http.StatusUnsupportedMediaType},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable},
+	{context.Canceled, StatusClientClosedRequest},
+}
+
+// StatusCode returns the HTTP status that corresponds to the given error.
+// Errors implementing StatusCoder give their own status, otherwise the first
+// skue error found in the chain of the error decides. Unknown errors are
+// reported as "500 Internal Server Error".
+// The models written for the earlier versions return the bare mgo.ErrNotFound
+// for the missing items, so the errors of the chain reading "not found" are
+// reported as "404 Not Found" too.
+func StatusCode(err error) int {
+	var coder StatusCoder
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+	for _, known := range errorStatus {
+		if errors.Is(err, known.err) {
+			return known.status
+		}
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if err.Error() == ErrNotFound.Error() {
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// clientGone tells whether the error happened because the client of the
+// request went away, such errors are not worth logging.
+func clientGone(r *http.Request, err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled)
+}
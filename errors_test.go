@@ -0,0 +1,83 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// teapot is an error giving its own status.
+type teapot struct{}
+
+func (teapot) Error() string {
+	return "short and stout"
+}
+
+func (teapot) StatusCode() int {
+	return http.StatusTeapot
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"wrapped", fmt.Errorf("reading team saprissa: %w", ErrNotFound), http.StatusNotFound},
+		{"status coder", fmt.Errorf("brewing: %w", teapot{}), http.StatusTeapot},
+		{"problem", NewProblem(http.StatusGone, ""), http.StatusGone},
+		{"validation", &ValidationError{}, http.StatusUnprocessableEntity},
+		{"hook", &HookError{Hook: HOOK_BeforeDelete, Err: ErrForbidden}, http.StatusForbidden},
+		{"bare not found", errors.New("not found"), http.StatusNotFound},
+		{"wrapped bare not found", fmt.Errorf("reading team: %w", errors.New("not found")), http.StatusNotFound},
+		{"unknown", errors.New("something went wrong"), http.StatusInternalServerError},
+	}
+	for _, known := range errorStatus {
+		tests = append(tests, struct {
+			name   string
+			err    error
+			status int
+		}{known.err.Error(), fmt.Errorf("wrapped: %w", known.err), known.status})
+	}
+	for _, test := range tests {
+		if got := StatusCode(test.err); got != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.status)
+		}
+	}
+}
+
+func TestStatusCodeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := StatusCode(ctx.Err()); got != StatusClientClosedRequest {
+		t.Errorf("canceled: got %d, want %d", got, StatusClientClosedRequest)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if got := StatusCode(ctx.Err()); got != http.StatusServiceUnavailable {
+		t.Errorf("deadline exceeded: got %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
@@ -22,64 +22,45 @@ package main
 
 import (
 	"./database"
+	"context"
 	"github.com/greivinlopez/skue"
+	"github.com/greivinlopez/skue/database"
 	"github.com/greivinlopez/skue/views"
 	"gopkg.in/martini.v1"
+	"gopkg.in/mgo.v2/bson"
+	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 var (
-	apiKey string
-	view   skue.ViewLayer
+	apiKey  string
+	cors    *skue.CORS
+	view    skue.ViewLayer
+	teams   *skue.Resource
+	players *skue.Resource
 )
 
 // ----------------------------------------------------------------------------
-// 			API Resource Handlers
+// 			API Resources
 // ----------------------------------------------------------------------------
 
-// ----------------------------------------------------------------------------
-// PLAYER
-
-// GET a Player resource by id
-func getPlayer(params martini.Params, w http.ResponseWriter, r *http.Request) {
-	id := params["id"]
-	player := models.NewPlayer(id)
-	skue.Read(view, player, nil, w, r)
-}
-
-// POST a new Player resource
-func createPlayer(w http.ResponseWriter, r *http.Request) {
-	player := models.NewPlayer("")
-	skue.Create(view, player, w, r)
+// auditDelete logs every deleted item along with the client that deleted it
+func auditDelete(model skue.DatabasePersistor, r *http.Request) error {
+	log.Printf("%s deleted by %s", r.URL.Path, r.RemoteAddr)
+	return nil
 }
 
-// GET the list of Player resources
-func listPlayers(w http.ResponseWriter, r *http.Request) {
-	player := models.NewPlayer("")
-	skue.List(view, player, w, r)
-}
-
-// ----------------------------------------------------------------------------
-// TEAM
-
-// GET a Team resource by id
-func getTeam(params martini.Params, w http.ResponseWriter, r *http.Request) {
-	id := params["team"]
-	team := models.NewTeam(id)
-	skue.Read(view, team, nil, w, r)
-}
-
-// POST a new Team resource
-func createTeam(w http.ResponseWriter, r *http.Request) {
-	team := models.NewTeam("")
-	skue.Create(view, team, w, r)
-}
-
-// GET the list of Team resources
-func listTeams(w http.ResponseWriter, r *http.Request) {
-	team := models.NewTeam("")
-	skue.List(view, team, w, r)
+// withTimeout gives up the requests still running after the given timeout,
+// cancelling their database and cache operations.
+func withTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 // ----------------------------------------------------------------------------
@@ -90,14 +71,28 @@ func init() {
 
 	// Retrieve the API security Key
 	apiKey = os.Getenv("SOCCER_API_KEY")
+	// Comma separated list of the origins allowed to use the API from a browser
+	cors = skue.NewCORS(strings.Split(os.Getenv("SOCCER_API_ORIGINS"), ",")...)
+	cors.AllowedHeaders = append(cors.AllowedHeaders, "X-API-KEY")
 	models.Address = os.Getenv("MG_DB_ADDRESS")
 	models.Username = os.Getenv("MG_DB_USER")
 	models.Password = os.Getenv("MG_DB_PASS")
 	models.Database = os.Getenv("MG_DB_DBNAME")
-	models.CreateMongoPersistor()
-
-	// Let's use a JSON view layer: Consume from JSON and produce JSON content.
-	view = *views.NewJSONView()
+	// Without a MongoDB server the models are kept in memory
+	if models.Address != "" {
+		models.CreateMongoPersistor()
+	} else {
+		models.CreateMemoryPersistor()
+	}
+
+	// Let's consume from JSON and produce JSON or XML content according to
+	// what each client accepts.
+	view = *views.NewView()
+	view.Hooks.AfterDelete = append(view.Hooks.AfterDelete, auditDelete)
+
+	// Teams and players are served straight from their stores
+	teams = skue.NewResource("/teams", view, skue.ModelFactory[models.Team, string](models.Teams, nil))
+	players = skue.NewResource("/teams/:team/players", view, skue.ModelFactory[models.Player, bson.ObjectId](models.Players, mongodb.ParseObjectId))
 }
 
 func main() {
@@ -107,24 +102,24 @@ func main() {
 	// Validate an API key for request authorization
 	m.Use(func(res http.ResponseWriter, req *http.Request) {
 		if req.Header.Get("X-API-KEY") != apiKey {
-			skue.ServiceResponse(view.Producer, res, req, http.StatusUnauthorized, "You are not authorized to access this resource.")
+			skue.ProduceProblem(view.Producer, res, req, skue.NewProblem(http.StatusUnauthorized, "You are not authorized to access this resource."))
 		}
 	})
 
 	// Team resource routing
-	m.Post("/teams", createTeam)
-	m.Get("/teams", listTeams)
-	m.Get("/teams/:team", getTeam)
-	m.Any("/teams", skue.NotAllowed)
-	m.Any("/teams/:team", skue.NotAllowed)
+	m.Any("/teams", teams.ServeHTTP)
+	m.Any("/teams/:team", teams.ServeHTTP)
 
 	// Player resource routing
-	m.Post("/teams/:team/players", createPlayer)
-	m.Get("/teams/:team/players", listPlayers)
-	m.Get("/teams/:team/players/:id", getPlayer)
-	m.Any("/teams/:team/players", skue.NotAllowed)
-	m.Any("/teams/:team/players/:id", skue.NotAllowed)
+	m.Any("/teams/:team/players", players.ServeHTTP)
+	m.Any("/teams/:team/players/:id", players.ServeHTTP)
 
 	// Running on an unassigned port by IANA: http://en.wikipedia.org/wiki/List_of_TCP_and_UDP_port_numbers
-	http.ListenAndServe(":3020", m)
+	// Each client IP address can make up to 600 requests per minute, the API
+	// key is not checked yet so clients could make up new ones
+	limiter := skue.NewRateLimiter(600, time.Minute, skue.NewMemoryRateLimitStore(), view)
+
+	// CORS preflight requests are answered before reaching martini
+	// and every request is given up after 10 seconds
+	http.ListenAndServe(":3020", cors.Handler(limiter.Handler(withTimeout(m, 10*time.Second))))
 }
@@ -22,8 +22,11 @@ package models
 
 import (
 	"github.com/greivinlopez/skue"
+	"github.com/greivinlopez/skue/cache/lru"
 	"github.com/greivinlopez/skue/database"
+	"github.com/greivinlopez/skue/database/memory"
 	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 var (
@@ -32,11 +35,31 @@ var (
 	Password string // The password of the MongoDB user
 	Database string // The name of the database to store the models
 	mongo    *mongodb.MongoDBPersistor
+
+	Players skue.Store[Player, bson.ObjectId] // The players collection
+	Teams   skue.Repository[Team]             // The teams collection
 )
 
 // Creates a MongoDB persistor to interact with the database
+// and the stores of the models on top of it. The models read are
+// cached in memory for two minutes.
 func CreateMongoPersistor() {
 	mongo = mongodb.New(Address, Username, Password, Database)
+	// Popular teams are refreshed before they expire from the cache, and
+	// the players not found are remembered for a while
+	mongo.ReadOptions.EarlyRefresh = 15 * time.Second
+	mongo.ReadOptions.NotFoundTTL = 10 * time.Second
+	cache := lru.New(lru.Options{MaxEntries: 10000, TTL: 2 * time.Minute})
+	Players = mongodb.NewStore[Player, bson.ObjectId](mongo, "players", cache)
+	Teams = mongodb.NewStore[Team, string](mongo, "teams", cache)
+}
+
+// Creates the stores of the models in memory, to try the API without a
+// MongoDB server. Everything is lost when the server stops.
+func CreateMemoryPersistor() {
+	persistor := memory.New()
+	Players = memory.NewStore[Player, bson.ObjectId](persistor, "players", nil)
+	Teams = memory.NewStore[Team, string](persistor, "teams", nil)
 }
 
 // ----------------------------------------------------------------------------
@@ -44,11 +67,11 @@ func CreateMongoPersistor() {
 // ----------------------------------------------------------------------------
 // Player represents a soccer player.
 type Player struct {
-	Id          bson.ObjectId `json:"Id" bson:"_id"`
-	FirstName   string
-	LastName    string
+	Id          bson.ObjectId `json:"Id" bson:"_id" skue:"id"`
+	FirstName   string        `validate:"required,max=50"`
+	LastName    string        `validate:"required,max=50"`
 	Nationality string
-	Age         int
+	Age         int `validate:"min=0,max=99"`
 	Position    string
 	Height      string
 	Weight      string
@@ -57,57 +80,14 @@ type Player struct {
 
 // ----------------------------------------------------------------------------
 
-// NewPlayer creates a new empty Player object with the provided id.
-// All the other fields will be empty at first.
-func NewPlayer(id string) *Player {
-	playerId := bson.NewObjectId()
-	if id != "" && bson.IsObjectIdHex(id) {
-		playerId = bson.ObjectIdHex(id)
+func (player *Player) QueryFields() skue.QueryFields {
+	return skue.QueryFields{
+		"nationality": {Type: skue.StringField},
+		"position":    {Type: skue.StringField},
+		"foot":        {Type: skue.StringField},
+		"age":         {Type: skue.IntField, Sortable: true},
+		"lastname":    {Type: skue.StringField, Sortable: true},
 	}
-	return &Player{
-		Id:          playerId,
-		FirstName:   "",
-		LastName:    "",
-		Nationality: "",
-		Age:         0,
-		Position:    "",
-		Height:      "",
-		Weight:      "",
-		Foot:        ""}
-}
-
-func (player *Player) Collection() string {
-	return "players"
-}
-
-// ----------------------------------------------------------------------------
-// 			Player implementation of skue.DatabasePersistor
-// ----------------------------------------------------------------------------
-
-func (player *Player) Read(cache skue.MemoryCacher) (err error) {
-	err = mongo.Read(cache, &player, player.Collection(), "_id", player.Id)
-	return
-}
-
-func (player *Player) Create() (err error) {
-	err = mongo.Create(&player, player.Collection())
-	return
-}
-
-func (player *Player) Update(cache skue.MemoryCacher) (err error) {
-	err = mongo.Update(cache, &player, player.Collection(), "_id", player.Id)
-	return
-}
-
-func (player *Player) Delete(cache skue.MemoryCacher) (err error) {
-	err = mongo.Delete(cache, player.Collection(), "_id", player.Id)
-	return
-}
-
-func (player *Player) List() (results interface{}, err error) {
-	players := []Player{}
-	err = mongo.List(&players, player.Collection(), nil, 25)
-	return players, err
 }
 
 // ----------------------------------------------------------------------------
@@ -117,8 +97,8 @@ func (player *Player) List() (results interface{}, err error) {
 // ----------------------------------------------------------------------------
 // Team represents a soccer team.
 type Team struct {
-	TeamId       string
-	Name         string
+	TeamId       string `validate:"required,regex=^[a-z0-9-]+$" skue:"id"`
+	Name         string `validate:"required"`
 	CompleteName string
 	Logo         string
 	Country      string
@@ -129,52 +109,12 @@ type Team struct {
 
 // ----------------------------------------------------------------------------
 
-// NewPlayer creates a new empty Player object with the provided id.
-// All the other fields will be empty at first.
-func NewTeam(id string) *Team {
-	return &Team{
-		TeamId:       id,
-		Name:         "",
-		CompleteName: "",
-		Logo:         "",
-		Country:      "",
-		Founded:      0,
-		Website:      "",
-		Players:      []Player{}}
-}
-
-func (team *Team) Collection() string {
-	return "teams"
-}
-
-// ----------------------------------------------------------------------------
-// 			Team implementation of skue.DatabasePersistor
-// ----------------------------------------------------------------------------
-
-func (team *Team) Read(cache skue.MemoryCacher) (err error) {
-	err = mongo.Read(cache, &team, team.Collection(), "teamid", team.TeamId)
-	return
-}
-
-func (team *Team) Create() (err error) {
-	err = mongo.Create(&team, team.Collection())
-	return
-}
-
-func (team *Team) Update(cache skue.MemoryCacher) (err error) {
-	err = mongo.Update(cache, &team, team.Collection(), "teamid", team.TeamId)
-	return
-}
-
-func (team *Team) Delete(cache skue.MemoryCacher) (err error) {
-	err = mongo.Delete(cache, team.Collection(), "teamid", team.TeamId)
-	return
-}
-
-func (team *Team) List() (results interface{}, err error) {
-	teams := []Team{}
-	err = mongo.List(&teams, team.Collection(), nil, 25)
-	return teams, err
+func (team *Team) QueryFields() skue.QueryFields {
+	return skue.QueryFields{
+		"country": {Type: skue.StringField},
+		"founded": {Type: skue.IntField, Sortable: true},
+		"name":    {Type: skue.StringField, Sortable: true},
+	}
 }
 
 // ----------------------------------------------------------------------------
@@ -0,0 +1,304 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// SPARSE FIELDSETS
+//
+// Clients can ask for a subset of the fields of the resources with the fields
+// query parameter, nested fields are separated by dots:
+//
+//    /teams?fields=Name,Country,Players.LastName
+//
+// Fields are matched by their JSON name, or the name of the struct field when
+// it has none, without taking case into account. The fields of embedded
+// structs are matched as if they were fields of the outer struct, like
+// encoding/json does.
+
+// fieldTree is a set of field paths organized as a tree.
+type fieldTree map[string]fieldTree
+
+// ParseFields returns the list of field paths of the fields query parameter
+// of the request, or nil if the client wants the whole resources.
+func ParseFields(r *http.Request) []string {
+	fields := []string{}
+	for _, value := range r.URL.Query()["fields"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// newFieldTree organizes the given field paths as a tree.
+func newFieldTree(fields []string) fieldTree {
+	tree := fieldTree{}
+	for _, field := range fields {
+		node := tree
+		for _, name := range strings.Split(strings.ToLower(field), ".") {
+			child, found := node[name]
+			if !found {
+				child = fieldTree{}
+				node[name] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// FieldName returns the name clients use for the given struct field: its
+// JSON name or, if it has none, the name of the field.
+func FieldName(field reflect.StructField) string {
+	if tag := field.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// ClientFields returns the fields of the struct type that clients see, the
+// fields of embedded structs included as encoding/json flattens them. The
+// Index of each field is the path to the field from the given type. Fields
+// found at several depths are only taken from the shallowest one.
+func ClientFields(t reflect.Type) []reflect.StructField {
+	depths := map[string]int{}
+	fields := []reflect.StructField{}
+	var walk func(t reflect.Type, index []int, visited map[reflect.Type]bool)
+	walk = func(t reflect.Type, index []int, visited map[reflect.Type]bool) {
+		visited[t] = true
+		defer delete(visited, t)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			field.Index = append(append([]int{}, index...), i)
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if field.Anonymous && embedded.Kind() == reflect.Struct && strings.Split(field.Tag.Get("json"), ",")[0] == "" {
+				if !visited[embedded] {
+					walk(embedded, field.Index, visited)
+				}
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.ToLower(FieldName(field))
+			if depth, found := depths[name]; found && depth <= len(field.Index) {
+				continue
+			} else if found {
+				// A shallower field hides the one found before
+				for j := range fields {
+					if strings.ToLower(FieldName(fields[j])) == name {
+						fields = append(fields[:j], fields[j+1:]...)
+						break
+					}
+				}
+			}
+			depths[name] = len(field.Index)
+			fields = append(fields, field)
+		}
+	}
+	walk(t, nil, map[reflect.Type]bool{})
+	return fields
+}
+
+// projectType returns a type with only the fields of the tree. The structs
+// created for the root of the value keep the XML element name of the original
+// type, given by the root parameter, as XML can not encode unnamed types.
+func projectType(t reflect.Type, tree fieldTree, root string) (reflect.Type, error) {
+	if len(tree) == 0 {
+		return t, nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		elem, err := projectType(t.Elem(), tree, root)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Kind() {
+		case reflect.Ptr:
+			return reflect.PtrTo(elem), nil
+		case reflect.Slice:
+			return reflect.SliceOf(elem), nil
+		}
+		return reflect.ArrayOf(t.Len(), elem), nil
+	case reflect.Interface:
+		// The type of the values is only known when projecting them
+		return t, nil
+	case reflect.Struct:
+		fields := []reflect.StructField{}
+		if _, named := t.FieldByName("XMLName"); !named && root != "" {
+			fields = append(fields, reflect.StructField{
+				Name: "XMLName",
+				Type: reflect.TypeOf(xml.Name{}),
+				Tag:  reflect.StructTag(`json:"-" xml:"` + root + `"`),
+			})
+		}
+		found := map[string]bool{}
+		names := map[string]bool{}
+		for _, field := range ClientFields(t) {
+			name := strings.ToLower(FieldName(field))
+			subtree, requested := tree[name]
+			if field.Name == "XMLName" {
+				fields = append(fields, reflect.StructField{Name: field.Name, Type: field.Type, Tag: field.Tag})
+				names[field.Name] = true
+				continue
+			} else if !requested {
+				continue
+			}
+			projected, err := projectType(field.Type, subtree, "")
+			if err != nil {
+				return nil, err
+			}
+			found[name] = true
+			// Fields promoted from embedded structs could have the name of
+			// another field, their JSON name is kept anyway
+			fieldName := field.Name
+			for names[fieldName] {
+				fieldName += "_"
+			}
+			names[fieldName] = true
+			fields = append(fields, reflect.StructField{Name: fieldName, Type: projected, Tag: field.Tag})
+		}
+		for name := range tree {
+			if !found[name] {
+				return nil, NewProblem(http.StatusBadRequest, fmt.Sprintf("Unknown field %q", name))
+			}
+		}
+		return reflect.StructOf(fields), nil
+	}
+	return nil, NewProblem(http.StatusBadRequest, "Fields can only be selected from objects")
+}
+
+// projectValue copies the fields of the source value into the destination
+// value, which is of the type given by projectType for the tree.
+func projectValue(dst, src reflect.Value, tree fieldTree) error {
+	if dst.Type() == src.Type() {
+		dst.Set(src)
+		return nil
+	}
+	switch src.Kind() {
+	case reflect.Ptr:
+		if src.IsNil() {
+			return nil
+		}
+		dst.Set(reflect.New(dst.Type().Elem()))
+		return projectValue(dst.Elem(), src.Elem(), tree)
+	case reflect.Slice:
+		if src.IsNil() {
+			return nil
+		}
+		dst.Set(reflect.MakeSlice(dst.Type(), src.Len(), src.Len()))
+		fallthrough
+	case reflect.Array:
+		for i := 0; i < src.Len(); i++ {
+			if err := projectValue(dst.Index(i), src.Index(i), tree); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		sources := map[string][]int{}
+		for _, field := range ClientFields(src.Type()) {
+			sources[strings.ToLower(FieldName(field))] = field.Index
+		}
+		for i := 0; i < dst.NumField(); i++ {
+			field := dst.Type().Field(i)
+			name := strings.ToLower(FieldName(field))
+			index, found := sources[name]
+			if !found {
+				continue
+			}
+			// Fields of nil embedded structs are left empty
+			value, err := src.FieldByIndexErr(index)
+			if err != nil {
+				continue
+			}
+			if err := projectValue(dst.Field(i), value, tree[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Project returns a copy of the value that only has the given fields.
+// The value must be a struct, a pointer to a struct or a slice of them.
+// Unknown fields are reported as a "400 Bad Request" problem.
+func Project(value interface{}, fields []string) (interface{}, error) {
+	if len(fields) == 0 || value == nil {
+		return value, nil
+	}
+	tree := newFieldTree(fields)
+	src := reflect.ValueOf(value)
+	// Interfaces like the items of a []interface{} are projected by the type
+	// of their values
+	if src.Kind() == reflect.Slice && src.Type().Elem().Kind() == reflect.Interface {
+		items := make([]interface{}, src.Len())
+		for i := range items {
+			item, err := Project(src.Index(i).Interface(), fields)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	root := src.Type()
+	for root.Kind() == reflect.Ptr || root.Kind() == reflect.Slice || root.Kind() == reflect.Array {
+		root = root.Elem()
+	}
+	t, err := projectType(src.Type(), tree, root.Name())
+	if err != nil {
+		return nil, err
+	}
+	dst := reflect.New(t).Elem()
+	if err := projectValue(dst, src, tree); err != nil {
+		return nil, err
+	}
+	return dst.Interface(), nil
+}
+
+// produceFields writes the value to the http writer with only the fields
+// requested by the client.
+func produceFields(view ViewLayer, w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	projected, err := Project(modelItem(value), ParseFields(r))
+	if err != nil {
+		ProduceError(view, w, r, err)
+		return
+	}
+	Produce(view.Producer, w, r, status, projected)
+}
@@ -0,0 +1,81 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type audit struct {
+	Created string `json:"created"`
+	Updated string `json:"updated"`
+}
+
+type person struct {
+	Name    string `json:"name"`
+	Country string `json:"country"`
+}
+
+type player struct {
+	*audit
+	person
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+}
+
+func TestProject(t *testing.T) {
+	full := player{
+		audit:  &audit{Created: "2014-06-12", Updated: "2014-06-24"},
+		person: person{Name: "Keylor", Country: "Costa Rica"},
+		Name:   "Navas",
+		Number: 1,
+	}
+	tests := []struct {
+		name   string
+		value  interface{}
+		fields []string
+		want   string
+	}{
+		{"top level", full, []string{"number"}, `{"number":1}`},
+		{"embedded", full, []string{"country", "created"}, `{"created":"2014-06-12","country":"Costa Rica"}`},
+		{"hidden by a shallower field", full, []string{"name"}, `{"name":"Navas"}`},
+		{"nil embedded", player{Number: 1}, []string{"created", "number"}, `{"created":"","number":1}`},
+		{"slice", []player{full}, []string{"country"}, `[{"country":"Costa Rica"}]`},
+	}
+	for _, test := range tests {
+		projected, err := Project(test.value, test.fields)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		output, err := json.Marshal(projected)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if string(output) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, output, test.want)
+		}
+	}
+
+	if _, err := Project(full, []string{"person"}); err == nil {
+		t.Errorf("embedded structs can not be selected by their name")
+	}
+}
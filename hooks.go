@@ -0,0 +1,266 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// LIFECYCLE HOOKS
+//
+// The persistence utils call hooks around the operations on the models.
+// Models take part by implementing any of the hook interfaces below, and
+// hooks for every model can be registered in the Hooks of a ViewLayer or a
+// Resource. Global hooks run before the hooks of the model.
+//
+// A before hook aborts the operation by returning an error, which is sent to
+// the client like any other error of the models wrapped in a *HookError.
+// Before hooks run once the model is decoded and before it is validated, so
+// they can set timestamps or check permissions and the values they set are
+// validated as well. After hooks run once the operation is done, so they can
+// audit it or update other items. The operation is already done by then, so
+// the errors of the after hooks of Create, Update, Patch and Delete are
+// logged to the ErrorLog of the view instead of being sent to the client;
+// only AfterRead and AfterList can still fail their operation.
+//
+// AfterList hooks get the items of the list and return the items sent to
+// the client, so the items kept from the client by AfterRead can be kept out
+// of the lists too.
+
+// HookEvent identifies the moment of an operation a hook runs at.
+type HookEvent string
+
+const (
+	HOOK_BeforeCreate HookEvent = "BeforeCreate"
+	HOOK_AfterCreate  HookEvent = "AfterCreate"
+	HOOK_BeforeRead   HookEvent = "BeforeRead"
+	HOOK_AfterRead    HookEvent = "AfterRead"
+	HOOK_BeforeUpdate HookEvent = "BeforeUpdate"
+	HOOK_AfterUpdate  HookEvent = "AfterUpdate"
+	HOOK_BeforeDelete HookEvent = "BeforeDelete"
+	HOOK_AfterDelete  HookEvent = "AfterDelete"
+	HOOK_BeforeList   HookEvent = "BeforeList"
+	HOOK_AfterList    HookEvent = "AfterList"
+)
+
+// HookFunc is a hook registered for every model of a view or a resource.
+type HookFunc func(model DatabasePersistor, r *http.Request) error
+
+// ListHookFunc is an AfterList hook registered for every model of a view or
+// a resource. It returns the items to be sent to the client.
+type ListHookFunc func(model DatabasePersistor, items interface{}, r *http.Request) (interface{}, error)
+
+// Hooks holds the global hooks for each one of the operations.
+type Hooks struct {
+	BeforeCreate []HookFunc
+	AfterCreate  []HookFunc
+	BeforeRead   []HookFunc
+	AfterRead    []HookFunc
+	BeforeUpdate []HookFunc
+	AfterUpdate  []HookFunc
+	BeforeDelete []HookFunc
+	AfterDelete  []HookFunc
+	BeforeList   []HookFunc
+	AfterList    []ListHookFunc
+}
+
+// BeforeCreateHook is implemented by models to run code before being created.
+type BeforeCreateHook interface {
+	BeforeCreate(r *http.Request) error
+}
+
+// AfterCreateHook is implemented by models to run code after being created.
+type AfterCreateHook interface {
+	AfterCreate(r *http.Request) error
+}
+
+// BeforeReadHook is implemented by models to run code before being read.
+type BeforeReadHook interface {
+	BeforeRead(r *http.Request) error
+}
+
+// AfterReadHook is implemented by models to run code after being read and
+// before being sent to the client.
+type AfterReadHook interface {
+	AfterRead(r *http.Request) error
+}
+
+// BeforeUpdateHook is implemented by models to run code before being
+// updated or patched.
+type BeforeUpdateHook interface {
+	BeforeUpdate(r *http.Request) error
+}
+
+// AfterUpdateHook is implemented by models to run code after being updated
+// or patched.
+type AfterUpdateHook interface {
+	AfterUpdate(r *http.Request) error
+}
+
+// BeforeDeleteHook is implemented by models to run code before being deleted.
+type BeforeDeleteHook interface {
+	BeforeDelete(r *http.Request) error
+}
+
+// AfterDeleteHook is implemented by models to run code after being deleted.
+type AfterDeleteHook interface {
+	AfterDelete(r *http.Request) error
+}
+
+// BeforeListHook is implemented by models to run code before their list is
+// read.
+type BeforeListHook interface {
+	BeforeList(r *http.Request) error
+}
+
+// AfterListHook is implemented by models to run code after their list is
+// read and before it is sent to the client. It returns the items to be sent.
+type AfterListHook interface {
+	AfterList(r *http.Request, items interface{}) (interface{}, error)
+}
+
+// HookError is returned when a hook aborts an operation. It wraps the error
+// returned by the hook, so the client gets the status of that error.
+type HookError struct {
+	Hook HookEvent
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return string(e.Hook) + " hook failed: " + e.Err.Error()
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// Add appends the hooks of other after the hooks of hooks, returning the
+// combined hooks.
+func (hooks Hooks) Add(other Hooks) Hooks {
+	join := func(first, second []HookFunc) []HookFunc {
+		if len(second) == 0 {
+			return first
+		}
+		return append(append([]HookFunc{}, first...), second...)
+	}
+	afterList := hooks.AfterList
+	if len(other.AfterList) > 0 {
+		afterList = append(append([]ListHookFunc{}, hooks.AfterList...), other.AfterList...)
+	}
+	return Hooks{
+		BeforeCreate: join(hooks.BeforeCreate, other.BeforeCreate),
+		AfterCreate:  join(hooks.AfterCreate, other.AfterCreate),
+		BeforeRead:   join(hooks.BeforeRead, other.BeforeRead),
+		AfterRead:    join(hooks.AfterRead, other.AfterRead),
+		BeforeUpdate: join(hooks.BeforeUpdate, other.BeforeUpdate),
+		AfterUpdate:  join(hooks.AfterUpdate, other.AfterUpdate),
+		BeforeDelete: join(hooks.BeforeDelete, other.BeforeDelete),
+		AfterDelete:  join(hooks.AfterDelete, other.AfterDelete),
+		BeforeList:   join(hooks.BeforeList, other.BeforeList),
+		AfterList:    afterList,
+	}
+}
+
+// run runs the global hooks and the hook of the model for the given event,
+// stopping at the first one that fails.
+func (hooks Hooks) run(event HookEvent, model DatabasePersistor, r *http.Request) error {
+	var global []HookFunc
+	var own func(r *http.Request) error
+	item := modelItem(model)
+	switch event {
+	case HOOK_BeforeCreate:
+		global = hooks.BeforeCreate
+		if hook, ok := item.(BeforeCreateHook); ok {
+			own = hook.BeforeCreate
+		}
+	case HOOK_AfterCreate:
+		global = hooks.AfterCreate
+		if hook, ok := item.(AfterCreateHook); ok {
+			own = hook.AfterCreate
+		}
+	case HOOK_BeforeRead:
+		global = hooks.BeforeRead
+		if hook, ok := item.(BeforeReadHook); ok {
+			own = hook.BeforeRead
+		}
+	case HOOK_AfterRead:
+		global = hooks.AfterRead
+		if hook, ok := item.(AfterReadHook); ok {
+			own = hook.AfterRead
+		}
+	case HOOK_BeforeUpdate:
+		global = hooks.BeforeUpdate
+		if hook, ok := item.(BeforeUpdateHook); ok {
+			own = hook.BeforeUpdate
+		}
+	case HOOK_AfterUpdate:
+		global = hooks.AfterUpdate
+		if hook, ok := item.(AfterUpdateHook); ok {
+			own = hook.AfterUpdate
+		}
+	case HOOK_BeforeDelete:
+		global = hooks.BeforeDelete
+		if hook, ok := item.(BeforeDeleteHook); ok {
+			own = hook.BeforeDelete
+		}
+	case HOOK_AfterDelete:
+		global = hooks.AfterDelete
+		if hook, ok := item.(AfterDeleteHook); ok {
+			own = hook.AfterDelete
+		}
+	case HOOK_BeforeList:
+		global = hooks.BeforeList
+		if hook, ok := item.(BeforeListHook); ok {
+			own = hook.BeforeList
+		}
+	default:
+		panic("skue: unknown hook event " + string(event))
+	}
+	for _, hook := range global {
+		if err := hook(model, r); err != nil {
+			return &HookError{Hook: event, Err: err}
+		}
+	}
+	if own != nil {
+		if err := own(r); err != nil {
+			return &HookError{Hook: event, Err: err}
+		}
+	}
+	return nil
+}
+
+// runAfterList runs the global AfterList hooks and the one of the model,
+// returning the items left by them.
+func (hooks Hooks) runAfterList(model DatabasePersistor, items interface{}, r *http.Request) (interface{}, error) {
+	var err error
+	for _, hook := range hooks.AfterList {
+		if items, err = hook(model, items, r); err != nil {
+			return nil, &HookError{Hook: HOOK_AfterList, Err: err}
+		}
+	}
+	if hook, ok := modelItem(model).(AfterListHook); ok {
+		if items, err = hook.AfterList(r, items); err != nil {
+			return nil, &HookError{Hook: HOOK_AfterList, Err: err}
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,161 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// PAGINATION
+//
+// Lists are paginated with the limit, offset and cursor query parameters and
+// the links to the other pages are sent in the Link header as described by
+// RFC 8288: http://tools.ietf.org/html/rfc8288
+
+var (
+	// DefaultLimit is the number of items of a page when the client does
+	// not ask for a particular limit.
+	DefaultLimit = 25
+	// MaxLimit is the maximum number of items a client can ask for.
+	MaxLimit = 100
+)
+
+// ListRequest represents the parameters of a request for a page of items.
+// There are two modes of pagination: in offset mode the page starts after
+// skipping Offset items, in cursor mode the page starts right after the item
+// identified by the Cursor, an opaque value given by the persistor.
+// The Query filters and sorts the items if the persistor is Queryable.
+// Fields are the paths of the fields requested by the client, persistors
+// can use them to fetch less data from the storage.
+type ListRequest struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Query  Query
+	Fields []string
+}
+
+// Page represents a page of items. Total is the number of items of the whole
+// list or -1 if the persistor does not know it. The cursors are only used in
+// cursor mode, an empty cursor means there is not such a page.
+type Page struct {
+	Items      interface{}
+	Total      int
+	NextCursor string
+	PrevCursor string
+}
+
+// Paginator is implemented by persistors that can list their items page by
+// page. skue.List uses it instead of the List method when available.
+type Paginator interface {
+	ListPage(request ListRequest) (page *Page, err error)
+}
+
+// ParseListRequest reads the pagination parameters from the query of the
+// request. Invalid values are reported as a "400 Bad Request" problem.
+func ParseListRequest(r *http.Request) (request ListRequest, err error) {
+	query := r.URL.Query()
+	request.Limit = DefaultLimit
+	if value := query.Get("limit"); value != "" {
+		request.Limit, err = strconv.Atoi(value)
+		if err != nil || request.Limit < 1 || request.Limit > MaxLimit {
+			return request, NewProblem(http.StatusBadRequest, fmt.Sprintf("The limit must be a number between 1 and %d", MaxLimit))
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		request.Offset, err = strconv.Atoi(value)
+		if err != nil || request.Offset < 0 {
+			return request, NewProblem(http.StatusBadRequest, "The offset must be a positive number")
+		}
+	}
+	request.Cursor = query.Get("cursor")
+	if request.Cursor != "" && request.Offset != 0 {
+		return request, NewProblem(http.StatusBadRequest, "The offset and cursor parameters can not be used together")
+	}
+	return request, nil
+}
+
+// pageLink returns the link to the page with the given parameters keeping
+// the rest of the query of the request.
+func pageLink(r *http.Request, rel string, params map[string]string) string {
+	query := r.URL.Query()
+	for _, name := range []string{"offset", "cursor"} {
+		query.Del(name)
+	}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf("<%s>; rel=\"%s\"", link.String(), rel)
+}
+
+// countItems returns the number of items of a slice or -1 if the value is
+// not a slice.
+func countItems(items interface{}) int {
+	value := reflect.ValueOf(items)
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return -1
+	}
+	return value.Len()
+}
+
+// setPageHeaders adds the Link header with the first, prev, next and last
+// pages of the list, and the X-Total-Count header when the total is known.
+// The cursors of the page are preferred over offsets to link the previous
+// and next pages.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, request ListRequest, page *Page) {
+	limit := strconv.Itoa(request.Limit)
+	links := []string{pageLink(r, "first", map[string]string{"limit": limit})}
+	if page.PrevCursor != "" {
+		links = append(links, pageLink(r, "prev", map[string]string{"limit": limit, "cursor": page.PrevCursor}))
+	} else if request.Offset > 0 {
+		prev := request.Offset - request.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(r, "prev", map[string]string{"limit": limit, "offset": strconv.Itoa(prev)}))
+	}
+	next := request.Offset + request.Limit
+	if page.NextCursor != "" {
+		links = append(links, pageLink(r, "next", map[string]string{"limit": limit, "cursor": page.NextCursor}))
+	} else if request.Cursor == "" {
+		if (page.Total >= 0 && next < page.Total) || (page.Total < 0 && countItems(page.Items) >= request.Limit) {
+			links = append(links, pageLink(r, "next", map[string]string{"limit": limit, "offset": strconv.Itoa(next)}))
+		}
+	}
+	if page.Total > 0 && request.Cursor == "" {
+		last := (page.Total - 1) / request.Limit * request.Limit
+		links = append(links, pageLink(r, "last", map[string]string{"limit": limit, "offset": strconv.Itoa(last)}))
+	}
+	w.Header().Set(HEADER_Link, strings.Join(links, ", "))
+	if page.Total >= 0 {
+		w.Header().Set(HEADER_XTotalCount, strconv.Itoa(page.Total))
+	}
+}
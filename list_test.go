@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseListRequest(t *testing.T) {
+	tests := []struct {
+		query   string
+		request ListRequest
+		err     bool
+	}{
+		{"", ListRequest{Limit: DefaultLimit}, false},
+		{"limit=10&offset=20", ListRequest{Limit: 10, Offset: 20}, false},
+		{"limit=10&cursor=abc", ListRequest{Limit: 10, Cursor: "abc"}, false},
+		{"offset=0&cursor=abc", ListRequest{Limit: DefaultLimit, Cursor: "abc"}, false},
+		{"limit=100", ListRequest{Limit: MaxLimit}, false},
+		{"limit=0", ListRequest{}, true},
+		{"limit=101", ListRequest{}, true},
+		{"limit=ten", ListRequest{}, true},
+		{"offset=-1", ListRequest{}, true},
+		{"offset=one", ListRequest{}, true},
+		{"offset=10&cursor=abc", ListRequest{}, true},
+	}
+	for _, test := range tests {
+		request, err := ParseListRequest(httptest.NewRequest("GET", "/teams?"+test.query, nil))
+		if test.err {
+			if StatusCode(err) != http.StatusBadRequest {
+				t.Errorf("%q: got error %v, want a 400 problem", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.query, err)
+		} else if request.Limit != test.request.Limit || request.Offset != test.request.Offset || request.Cursor != test.request.Cursor {
+			t.Errorf("%q: got %+v, want %+v", test.query, request, test.request)
+		}
+	}
+}
+
+func TestSetPageHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		page  Page
+		links []string
+		total string
+	}{
+		{
+			"first page", "limit=10", Page{Items: []int{}, Total: 25},
+			[]string{`</teams?limit=10>; rel="first"`, `</teams?limit=10&offset=10>; rel="next"`, `</teams?limit=10&offset=20>; rel="last"`},
+			"25",
+		},
+		{
+			"middle page", "limit=10&offset=10&name=Saprissa", Page{Items: []int{}, Total: 25},
+			[]string{`</teams?limit=10&name=Saprissa>; rel="first"`, `</teams?limit=10&name=Saprissa&offset=0>; rel="prev"`, `</teams?limit=10&name=Saprissa&offset=20>; rel="next"`, `</teams?limit=10&name=Saprissa&offset=20>; rel="last"`},
+			"25",
+		},
+		{
+			"last page", "limit=10&offset=20", Page{Items: []int{}, Total: 25},
+			[]string{`</teams?limit=10>; rel="first"`, `</teams?limit=10&offset=10>; rel="prev"`, `</teams?limit=10&offset=20>; rel="last"`},
+			"25",
+		},
+		{
+			"unknown total", "limit=2", Page{Items: []int{1, 2}, Total: -1},
+			[]string{`</teams?limit=2>; rel="first"`, `</teams?limit=2&offset=2>; rel="next"`},
+			"",
+		},
+		{
+			"unknown total last page", "limit=2&offset=2", Page{Items: []int{3}, Total: -1},
+			[]string{`</teams?limit=2>; rel="first"`, `</teams?limit=2&offset=0>; rel="prev"`},
+			"",
+		},
+		{
+			"cursors", "limit=2&cursor=b", Page{Items: []int{3, 4}, Total: -1, NextCursor: "c", PrevCursor: "a"},
+			[]string{`</teams?limit=2>; rel="first"`, `</teams?cursor=a&limit=2>; rel="prev"`, `</teams?cursor=c&limit=2>; rel="next"`},
+			"",
+		},
+		{
+			"empty", "", Page{Items: []int{}, Total: 0},
+			[]string{`</teams?limit=25>; rel="first"`},
+			"0",
+		},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/teams?"+test.query, nil)
+		request, err := ParseListRequest(r)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		w := httptest.NewRecorder()
+		setPageHeaders(w, r, request, &test.page)
+		if got, want := w.Header().Get(HEADER_Link), strings.Join(test.links, ", "); got != want {
+			t.Errorf("%s: got Link %s, want %s", test.name, got, want)
+		}
+		if got := w.Header().Get(HEADER_XTotalCount); got != test.total {
+			t.Errorf("%s: got %s %q, want %q", test.name, HEADER_XTotalCount, got, test.total)
+		}
+	}
+}
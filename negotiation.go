@@ -0,0 +1,379 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// CONTENT NEGOTIATION
+//
+// Proactive negotiation as described by RFC 7231 section 3.4.1 and the Accept
+// header field as described by RFC 7231 section 5.3.2:
+//   http://tools.ietf.org/html/rfc7231#section-5.3.2
+
+// mediaRange represents a single element of an Accept header field: a media
+// range with its parameters and its quality value.
+type mediaRange struct {
+	mainType string
+	subType  string
+	params   map[string]string
+	quality  float64
+}
+
+// splitHeader splits a comma separated header field value into its elements
+// ignoring the commas found inside quoted strings.
+func splitHeader(value string) []string {
+	elements := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				if element := strings.TrimSpace(value[start:i]); element != "" {
+					elements = append(elements, element)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if element := strings.TrimSpace(value[start:]); element != "" {
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// parseQuality parses a quality value (qvalue) as defined by RFC 7231
+// section 5.3.1. Invalid values are reported with ok set to false.
+func parseQuality(value string) (quality float64, ok bool) {
+	quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || quality < 0 || quality > 1 {
+		return 0, false
+	}
+	return quality, true
+}
+
+// splitMediaType splits a media type into its type and subtype.
+func splitMediaType(mediaType string) (mainType, subType string) {
+	parts := strings.SplitN(mediaType, "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// parseAccept parses the value of an Accept header field into a list of
+// media ranges. Invalid elements are ignored.
+func parseAccept(accept string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, element := range splitHeader(accept) {
+		// Some clients send a single "*" as a shortcut for "*/*"
+		if element == "*" || strings.HasPrefix(element, "*;") {
+			element = "*/*" + element[1:]
+		}
+		// Parameters after the quality value are accept extensions and
+		// they do not take part in the matching.
+		quality, ok := 1.0, true
+		parts := strings.Split(element, ";")
+		for i := 1; i < len(parts); i++ {
+			param := strings.SplitN(parts[i], "=", 2)
+			if len(param) == 2 && strings.EqualFold(strings.TrimSpace(param[0]), "q") {
+				quality, ok = parseQuality(param[1])
+				element = strings.Join(parts[:i], ";")
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(element)
+		if err != nil {
+			continue
+		}
+		accepted := mediaRange{params: params, quality: quality}
+		accepted.mainType, accepted.subType = splitMediaType(mediaType)
+		if accepted.mainType == "*" && accepted.subType != "*" {
+			continue
+		}
+		ranges = append(ranges, accepted)
+	}
+	return ranges
+}
+
+// match returns how specific is the match of the media range with the given
+// media type, or -1 if the media type is not included in the range.
+// According to RFC 7231 more specific media ranges override less specific
+// ones: "text/plain;format=flowed" > "text/plain" > "text/*" > "*/*"
+func (accepted mediaRange) match(mainType, subType string, params map[string]string) int {
+	specificity := 0
+	switch {
+	case accepted.mainType == "*" && accepted.subType == "*":
+		specificity = 0
+	case accepted.mainType == mainType && accepted.subType == "*":
+		specificity = 1
+	case accepted.mainType == mainType && accepted.subType == subType:
+		specificity = 2
+	default:
+		return -1
+	}
+	for name, value := range accepted.params {
+		if !strings.EqualFold(params[name], value) {
+			return -1
+		}
+	}
+	return specificity<<8 + len(accepted.params)
+}
+
+// negotiate returns the index of the offered media type that best matches the
+// given Accept header field value or -1 if none of them is acceptable.
+// The offers are expected in order of server preference which is used to
+// break ties between equally acceptable media types.
+func negotiate(accept string, offers []string) int {
+	if len(offers) == 0 {
+		return -1
+	}
+	ranges := parseAccept(accept)
+	// A request without any Accept header field implies that the user agent
+	// will accept any media type in response.
+	if len(ranges) == 0 {
+		return 0
+	}
+	best, bestQuality, bestSpecificity := -1, 0.0, -1
+	for i, offer := range offers {
+		mediaType, params, err := mime.ParseMediaType(offer)
+		if err != nil {
+			mediaType, params = strings.ToLower(offer), nil
+		}
+		mainType, subType := splitMediaType(mediaType)
+
+		// The quality of the offer is given by the most specific media
+		// range that matches it
+		quality, specificity := 0.0, -1
+		for _, accepted := range ranges {
+			if s := accepted.match(mainType, subType, params); s > specificity {
+				quality, specificity = accepted.quality, s
+			}
+		}
+		if specificity < 0 || quality == 0 {
+			continue
+		}
+		if quality > bestQuality || (quality == bestQuality && specificity > bestSpecificity) {
+			best, bestQuality, bestSpecificity = i, quality, specificity
+		}
+	}
+	return best
+}
+
+// NegotiateMediaType returns the best media type from the offered ones for the
+// given Accept header field value. The offers must be listed in order of
+// preference, the first one is chosen when the Accept header is not present.
+// Returns false if none of the offered media types is acceptable.
+func NegotiateMediaType(accept string, offers []string) (string, bool) {
+	i := negotiate(accept, offers)
+	if i < 0 {
+		return "", false
+	}
+	return offers[i], true
+}
+
+// AddVary adds the given header field names to the Vary header of the given
+// response headers unless they are already listed.
+func AddVary(header http.Header, fields ...string) {
+	existing := []string{}
+	for _, value := range header[HEADER_Vary] {
+		existing = append(existing, splitHeader(value)...)
+	}
+	for _, field := range fields {
+		found := false
+		for _, name := range existing {
+			if name == "*" || strings.EqualFold(name, field) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			header.Add(HEADER_Vary, field)
+			existing = append(existing, field)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+// PRODUCERS
+
+// Producers is a Producer composed by several producers, each one of them
+// for a different MIME type. When used through Produce the producer is chosen
+// per request according to the Accept header. The first producer is the
+// default one.
+type Producers []Producer
+
+// MimeType returns the MIME type of the default producer.
+func (producers Producers) MimeType() string {
+	if len(producers) == 0 {
+		return ""
+	}
+	return producers[0].MimeType()
+}
+
+// Out writes the value using the default producer.
+func (producers Producers) Out(w http.ResponseWriter, statusCode int, value interface{}) {
+	if len(producers) == 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	producers[0].Out(w, statusCode, value)
+}
+
+// Select returns the producer that best matches the given Accept header
+// field value. Returns false if none of the producers is acceptable.
+func (producers Producers) Select(accept string) (Producer, bool) {
+	candidates := flattenProducers(producers)
+	offers := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		offers[i] = candidate.MimeType()
+	}
+	i := negotiate(accept, offers)
+	if i < 0 {
+		return nil, false
+	}
+	return candidates[i], true
+}
+
+// flattenProducers returns the list of single producers contained by the
+// given producer.
+func flattenProducers(producer Producer) []Producer {
+	producers, ok := producer.(Producers)
+	if !ok {
+		return []Producer{producer}
+	}
+	result := []Producer{}
+	for _, p := range producers {
+		result = append(result, flattenProducers(p)...)
+	}
+	return result
+}
+
+// ----------------------------------------------------------------------------
+// CONSUMERS
+
+// Consumers is a Consumer composed by several consumers, each one of them
+// registered for a different MIME type. When used through Consume the
+// consumer is chosen per request according to the Content-Type header.
+// The first consumer is the default one.
+type Consumers []Consumer
+
+// MimeType returns the MIME type of the default consumer.
+func (consumers Consumers) MimeType() string {
+	if len(consumers) == 0 {
+		return ""
+	}
+	return consumers[0].MimeType()
+}
+
+// In decodes the request using the consumer registered for its Content-Type.
+func (consumers Consumers) In(r *http.Request, value interface{}) error {
+	consumer, ok := consumers.Select(r.Header.Get(HEADER_ContentType))
+	if !ok {
+		return ErrUnsupportedMediaType
+	}
+	return consumer.In(r, value)
+}
+
+// Select returns the consumer registered for the media type of the given
+// Content-Type header field value. Parameters like charset or boundary do
+// not take part in the selection unless the consumer MIME type declares them.
+// Structured syntax suffixes (RFC 6839) are used as a fallback, so a
+// "application/vnd.api+json" content is decoded by an "application/json"
+// consumer when there is not a more specific one. Consumers registered for
+// a media range like "text/*" or "*/*" decode the contents no other consumer
+// understands, the most specific range first. A Content-Type that is itself
+// a media range is never matched.
+// Returns false if none of the consumers can decode the content.
+func (consumers Consumers) Select(contentType string) (Consumer, bool) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	mainType, subType := splitMediaType(mediaType)
+	if mainType == "*" || subType == "*" {
+		return nil, false
+	}
+	lookups := []string{mediaType}
+	if i := strings.LastIndex(subType, "+"); i >= 0 {
+		lookups = append(lookups, mainType+"/"+subType[i+1:])
+	}
+	lookups = append(lookups, mainType+"/*", "*/*")
+	candidates := flattenConsumers(consumers)
+	for _, lookup := range lookups {
+		for _, candidate := range candidates {
+			if matchMediaType(candidate.MimeType(), lookup, params) {
+				return candidate, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// matchMediaType reports whether the given media type and parameters are
+// the ones described by the MIME type of a consumer.
+func matchMediaType(mimeType string, mediaType string, params map[string]string) bool {
+	expected, expectedParams, err := mime.ParseMediaType(mimeType)
+	if err != nil || expected != mediaType {
+		return false
+	}
+	for name, value := range expectedParams {
+		if !strings.EqualFold(params[name], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// flattenConsumers returns the list of single consumers contained by the
+// given consumer.
+func flattenConsumers(consumer Consumer) []Consumer {
+	consumers, ok := consumer.(Consumers)
+	if !ok {
+		return []Consumer{consumer}
+	}
+	result := []Consumer{}
+	for _, c := range consumers {
+		result = append(result, flattenConsumers(c)...)
+	}
+	return result
+}
+
+// ParseContentType returns the media type of the request body along with its
+// parameters, like charset or boundary, as found in the Content-Type header.
+func ParseContentType(r *http.Request) (mediaType string, params map[string]string, err error) {
+	return mime.ParseMediaType(r.Header.Get(HEADER_ContentType))
+}
@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateMediaType(t *testing.T) {
+	offers := []string{MIME_JSON, MIME_XML}
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", MIME_JSON, true},
+		{"*/*", MIME_JSON, true},
+		{"*", MIME_JSON, true},
+		{"application/xml", MIME_XML, true},
+		{"APPLICATION/XML", MIME_XML, true},
+		{"application/xml;q=0.9, application/json", MIME_JSON, true},
+		{"application/json;q=0.5, application/xml", MIME_XML, true},
+		{"application/*;q=0.5, application/xml", MIME_XML, true},
+		{"application/*", MIME_JSON, true},
+		{"*/*;q=0.1, application/json;q=0", MIME_XML, true},
+		{"application/xml, application/*;q=0", MIME_XML, true},
+		{"application/json;q=0.8, */*;q=0.9", MIME_XML, true},
+		{"application/xml;q=2", MIME_JSON, true},
+		{"*/*;q=0", "", false},
+		{"application/*;q=0", "", false},
+		{"text/html", "", false},
+	}
+	for _, test := range tests {
+		got, ok := NegotiateMediaType(test.accept, offers)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.accept, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+// testProducer writes the values as JSON with its own MIME type.
+type testProducer string
+
+func (producer testProducer) MimeType() string {
+	return string(producer)
+}
+
+func (producer testProducer) Out(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set(HEADER_ContentType, string(producer))
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(value)
+}
+
+// testConsumer reads JSON values for its own MIME type.
+type testConsumer string
+
+func (consumer testConsumer) MimeType() string {
+	return string(consumer)
+}
+
+func (consumer testConsumer) In(r *http.Request, value interface{}) error {
+	return json.NewDecoder(r.Body).Decode(value)
+}
+
+func TestProduce(t *testing.T) {
+	producer := Producers{testProducer(MIME_JSON), testProducer(MIME_XML)}
+	tests := []struct {
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"application/xml", http.StatusOK, MIME_XML},
+		{"application/xml;q=0.9, application/json", http.StatusOK, MIME_JSON},
+		{"*/*;q=0", http.StatusNotAcceptable, MIME_PROBLEM_JSON},
+		{"text/html", http.StatusNotAcceptable, MIME_PROBLEM_JSON},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/players/1", nil)
+		r.Header.Set(HEADER_Accept, test.accept)
+		w := httptest.NewRecorder()
+		Produce(producer, w, r, http.StatusOK, map[string]string{"name": "Keylor"})
+		if w.Code != test.status || w.Header().Get(HEADER_ContentType) != test.contentType {
+			t.Errorf("%q: got %d %q, want %d %q", test.accept, w.Code, w.Header().Get(HEADER_ContentType), test.status, test.contentType)
+		}
+		if w.Header().Get(HEADER_Vary) != HEADER_Accept {
+			t.Errorf("%q: got Vary %q, want Accept", test.accept, w.Header().Get(HEADER_Vary))
+		}
+	}
+}
+
+func TestSelectConsumer(t *testing.T) {
+	consumers := Consumers{
+		testConsumer(MIME_JSON),
+		Consumers{testConsumer(MIME_XML)},
+		testConsumer("text/plain; charset=utf-8"),
+		testConsumer("text/*"),
+	}
+	tests := []struct {
+		contentType string
+		want        string
+		ok          bool
+	}{
+		{"application/json", MIME_JSON, true},
+		{"Application/JSON; charset=utf-8", MIME_JSON, true},
+		{"application/xml", MIME_XML, true},
+		{"application/vnd.skue+json", MIME_JSON, true},
+		{"application/problem+xml", MIME_XML, true},
+		{"text/plain; charset=UTF-8", "text/plain; charset=utf-8", true},
+		{"text/plain; charset=latin1", "text/*", true},
+		{"text/plain", "text/*", true},
+		{"text/csv", "text/*", true},
+		{"application/yaml", "", false},
+		{"application/*", "", false},
+		{"*/*", "", false},
+		{"application/json; charset", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		got, ok := consumers.Select(test.contentType)
+		mimeType := ""
+		if ok {
+			mimeType = got.MimeType()
+		}
+		if mimeType != test.want || ok != test.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", test.contentType, mimeType, ok, test.want, test.ok)
+		}
+	}
+
+	catchAll := Consumers{testConsumer("*/*"), testConsumer(MIME_JSON)}
+	if got, ok := catchAll.Select("image/png"); !ok || got.MimeType() != "*/*" {
+		t.Errorf("image/png: got %v, %v, want */*", got, ok)
+	}
+	if got, ok := catchAll.Select(MIME_JSON); !ok || got.MimeType() != MIME_JSON {
+		t.Errorf("%s: got %v, %v, want %s", MIME_JSON, got, ok, MIME_JSON)
+	}
+}
+
+func TestParseContentType(t *testing.T) {
+	r := httptest.NewRequest("POST", "/players", nil)
+	r.Header.Set(HEADER_ContentType, `multipart/form-data; Boundary="a b"; charset=UTF-8`)
+	mediaType, params, err := ParseContentType(r)
+	if err != nil || mediaType != "multipart/form-data" {
+		t.Fatalf("got %q, %v, want multipart/form-data", mediaType, err)
+	}
+	if params["boundary"] != "a b" || params["charset"] != "UTF-8" {
+		t.Errorf("got params %v, want boundary and charset", params)
+	}
+
+	r.Header.Set(HEADER_ContentType, "application/json; charset")
+	if _, _, err := ParseContentType(r); err == nil {
+		t.Errorf("invalid Content-Type: got no error")
+	}
+}
+
+func TestConsumeUnsupportedMediaType(t *testing.T) {
+	for _, contentType := range []string{"application/yaml", "*/*", ""} {
+		r := httptest.NewRequest("POST", "/players", strings.NewReader(`{"name":"Keylor"}`))
+		r.Header.Set(HEADER_ContentType, contentType)
+		w := httptest.NewRecorder()
+		var value map[string]string
+		err := Consume(testConsumer(MIME_JSON), w, r, &value)
+		if err != ErrUnsupportedMediaType {
+			t.Errorf("%q: got %v, want ErrUnsupportedMediaType", contentType, err)
+		}
+		if w.Code != http.StatusUnsupportedMediaType || w.Header().Get(HEADER_ContentType) != MIME_PROBLEM_JSON {
+			t.Errorf("%q: got %d %q, want 415 %q", contentType, w.Code, w.Header().Get(HEADER_ContentType), MIME_PROBLEM_JSON)
+		}
+		if value != nil {
+			t.Errorf("%q: got %v, want nothing decoded", contentType, value)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/players", strings.NewReader(`{"name":"Keylor"}`))
+	r.Header.Set(HEADER_ContentType, "application/json; charset=utf-8")
+	w := httptest.NewRecorder()
+	var value map[string]string
+	if err := Consume(testConsumer(MIME_JSON), w, r, &value); err != nil || value["name"] != "Keylor" {
+		t.Errorf("got %v, %v, want Keylor", value, err)
+	}
+}
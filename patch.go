@@ -0,0 +1,479 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// PATCH DOCUMENTS
+//
+// Partial modifications of JSON documents as described by:
+//   RFC 7396 JSON Merge Patch: http://tools.ietf.org/html/rfc7396
+//   RFC 6902 JSON Patch: http://tools.ietf.org/html/rfc6902
+//
+// Malformed patch documents are reported as "400 Bad Request" problems and
+// patches that can not be applied to the document wrap ErrConflict.
+
+// decodeJSON decodes a JSON text keeping the numbers as they are.
+func decodeJSON(data []byte) (value interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	return
+}
+
+// badPatch returns the error for a malformed patch document.
+func badPatch(format string, args ...interface{}) error {
+	return NewProblem(http.StatusBadRequest, "Invalid patch document: "+fmt.Sprintf(format, args...))
+}
+
+// MergePatch applies the given JSON merge patch to the JSON document.
+func MergePatch(document, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := decodeJSON(patch)
+	if err != nil {
+		return nil, badPatch("%v", err)
+	}
+	return json.Marshal(mergePatch(target, changes))
+}
+
+// mergePatch implements the MergePatch function defined by RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergePatch(object[name], value)
+		}
+	}
+	return object
+}
+
+// patchOperation represents a single operation of a JSON patch.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// JSONPatch applies the given JSON patch to the JSON document. Operations
+// are applied in order and none of them is applied if any of them fails.
+func JSONPatch(document, patch []byte) ([]byte, error) {
+	target, err := decodeJSON(document)
+	if err != nil {
+		return nil, err
+	}
+	operations := []patchOperation{}
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, badPatch("%v", err)
+	}
+	for i, operation := range operations {
+		target, err = operation.apply(target)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return json.Marshal(target)
+}
+
+// apply applies the operation to the document and returns the new document.
+func (operation patchOperation) apply(document interface{}) (interface{}, error) {
+	if operation.Path == nil {
+		return nil, badPatch("missing path in %q operation", operation.Op)
+	}
+	path, err := parsePointer(*operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch operation.Op {
+	case "add", "replace", "test":
+		if len(operation.Value) == 0 {
+			return nil, badPatch("missing value in %q operation", operation.Op)
+		}
+		if value, err = decodeJSON(operation.Value); err != nil {
+			return nil, badPatch("%v", err)
+		}
+	case "move", "copy":
+		if operation.From == nil {
+			return nil, badPatch("missing from in %q operation", operation.Op)
+		}
+		from, err := parsePointer(*operation.From)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = resolvePointer(document, from); err != nil {
+			return nil, err
+		}
+		if operation.Op == "copy" {
+			value = copyJSON(value)
+		} else {
+			if strings.HasPrefix(*operation.Path, *operation.From+"/") {
+				return nil, badPatch("can not move %q into one of its children", *operation.From)
+			}
+			if document, err = removeValue(document, from); err != nil {
+				return nil, err
+			}
+		}
+	case "remove":
+	default:
+		return nil, badPatch("unknown operation %q", operation.Op)
+	}
+
+	switch operation.Op {
+	case "add", "move", "copy":
+		return addValue(document, path, value)
+	case "remove":
+		return removeValue(document, path)
+	case "replace":
+		if _, err := resolvePointer(document, path); err != nil {
+			return nil, err
+		}
+		if document, err = removeValue(document, path); err != nil {
+			return nil, err
+		}
+		return addValue(document, path, value)
+	}
+	// test
+	current, err := resolvePointer(document, path)
+	if err != nil {
+		return nil, err
+	}
+	if !equalJSON(current, value) {
+		return nil, fmt.Errorf("%w: test failed for %q", ErrConflict, *operation.Path)
+	}
+	return document, nil
+}
+
+// parsePointer parses a JSON pointer (RFC 6901) into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, badPatch("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index of a JSON pointer. The end of the array
+// ("-" or its length) is only valid when adding values.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, badPatch("invalid array index %q", token)
+	}
+	if index > length || (index == length && !adding) {
+		return 0, fmt.Errorf("%w: array index %d out of bounds", ErrConflict, index)
+	}
+	return index, nil
+}
+
+// resolvePointer returns the value referenced by the tokens in the document.
+func resolvePointer(document interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := document.(type) {
+		case map[string]interface{}:
+			value, found := container[token]
+			if !found {
+				return nil, fmt.Errorf("%w: member %q not found", ErrConflict, token)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			document = container[index]
+		default:
+			return nil, fmt.Errorf("%w: can not resolve %q in a scalar value", ErrConflict, token)
+		}
+	}
+	return document, nil
+}
+
+// changeParent walks the document to the container referenced by all the
+// tokens but the last one, and replaces it with the result of the change
+// function. Returns the new document.
+func changeParent(document interface{}, tokens []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return change(document, tokens[0])
+	}
+	switch container := document.(type) {
+	case map[string]interface{}:
+		child, found := container[tokens[0]]
+		if !found {
+			return nil, fmt.Errorf("%w: member %q not found", ErrConflict, tokens[0])
+		}
+		child, err := changeParent(child, tokens[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		container[tokens[0]] = child
+		return container, nil
+	case []interface{}:
+		index, err := arrayIndex(tokens[0], len(container), false)
+		if err != nil {
+			return nil, err
+		}
+		child, err := changeParent(container[index], tokens[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		container[index] = child
+		return container, nil
+	}
+	return nil, fmt.Errorf("%w: can not resolve %q in a scalar value", ErrConflict, tokens[0])
+}
+
+// addValue adds the value at the location referenced by the tokens.
+func addValue(document interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return changeParent(document, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("%w: can not add %q to a scalar value", ErrConflict, token)
+	})
+}
+
+// removeValue removes the value at the location referenced by the tokens.
+func removeValue(document interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, badPatch("can not remove the whole document")
+	}
+	return changeParent(document, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch container := parent.(type) {
+		case map[string]interface{}:
+			if _, found := container[token]; !found {
+				return nil, fmt.Errorf("%w: member %q not found", ErrConflict, token)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: can not remove %q from a scalar value", ErrConflict, token)
+	})
+}
+
+// copyJSON returns a deep copy of a decoded JSON value.
+func copyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(v))
+		for name, member := range v {
+			object[name] = copyJSON(member)
+		}
+		return object
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, item := range v {
+			array[i] = copyJSON(item)
+		}
+		return array
+	}
+	return value
+}
+
+// equalJSON reports whether two decoded JSON values are equal. Numbers are
+// compared by their numeric value.
+func equalJSON(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, member := range x {
+			other, found := y[name]
+			if !found || !equalJSON(member, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalJSON(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// applyPatch applies the patch document in the body of the request to the
+// model. The kind of patch is chosen by the Content-Type of the request.
+// The patched document replaces the JSON members of the model, so members
+// removed by the patch get their zero value, while the fields that are not
+// encoded as JSON keep their value. Patches changing the id of the model,
+// the field tagged with `skue:"id"`, are rejected.
+func applyPatch(model interface{}, r *http.Request) error {
+	mediaType, _, err := ParseContentType(r)
+	var patcher func(document, patch []byte) ([]byte, error)
+	switch {
+	case err != nil:
+		return ErrUnsupportedMediaType
+	case mediaType == MIME_MERGE_PATCH:
+		patcher = MergePatch
+	case mediaType == MIME_JSON_PATCH:
+		patcher = JSONPatch
+	default:
+		return ErrUnsupportedMediaType
+	}
+	err = decompressBody(r)
+	if err == ErrUnsupportedMediaType {
+		return err
+	}
+	var patch []byte
+	if err == nil {
+		patch, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		return &readError{err}
+	}
+	document, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	patched, err := patcher(document, patch)
+	if err != nil {
+		return err
+	}
+	value := reflect.ValueOf(model)
+	if value.Kind() != reflect.Ptr {
+		return fmt.Errorf("can not patch a model of type %T", model)
+	}
+	fresh := reflect.New(value.Elem().Type())
+	fresh.Elem().Set(value.Elem())
+	resetJSONFields(fresh.Elem())
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.UseNumber()
+	if err := decoder.Decode(fresh.Interface()); err != nil {
+		return fmt.Errorf("%w: %v", ErrValidationFailed, err)
+	}
+	if field, ok := IDField(value.Type()); ok {
+		id := value.Elem().FieldByIndex(field.Index).Interface()
+		if !reflect.DeepEqual(id, fresh.Elem().FieldByIndex(field.Index).Interface()) {
+			return NewProblem(http.StatusUnprocessableEntity, "The id of the item can not be changed")
+		}
+	}
+	value.Elem().Set(fresh.Elem())
+	return nil
+}
+
+// resetJSONFields sets the zero value to the fields of the struct that are
+// encoded as JSON, the fields of embedded structs included.
+func resetJSONFields(value reflect.Value) {
+	if value.Kind() != reflect.Struct {
+		value.Set(reflect.Zero(value.Type()))
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			resetJSONFields(value.Field(i))
+		} else if field.PkgPath == "" {
+			value.Field(i).Set(reflect.Zero(field.Type))
+		}
+	}
+}
+
+// IDField returns the field of the struct type tagged as the id of its
+// items with the skue:"id" tag.
+func IDField(t reflect.Type) (field reflect.StructField, ok bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return field, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field = t.Field(i)
+		for _, flag := range strings.Split(field.Tag.Get("skue"), ",") {
+			if flag == "id" {
+				return field, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
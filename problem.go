@@ -0,0 +1,294 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// PROBLEM DETAILS
+//
+// Error responses following RFC 7807 "Problem Details for HTTP APIs":
+//   http://tools.ietf.org/html/rfc7807
+
+// Problem represents the details of an error in an HTTP response.
+// Type is a URI reference that identifies the problem type, when it is empty
+// "about:blank" is assumed. Extensions holds any additional member of the
+// problem, its values must be encodable by the producers of the view.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+// ProblemMapper translates an error into the problem that will be sent to the
+// client as the response.
+type ProblemMapper func(err error) *Problem
+
+// NewProblem creates a new problem for the given HTTP status with the status
+// text as its title.
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Title:  statusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// statusText returns the text of the given HTTP status, including the ones
+// defined by skue.
+func statusText(status int) string {
+	if status == StatusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+// Error returns a description of the problem. It allows problems to be
+// returned as errors by the models and to be sent as they are to the client.
+func (problem *Problem) Error() string {
+	if problem.Detail != "" {
+		return problem.Title + ": " + problem.Detail
+	}
+	return problem.Title
+}
+
+// MarshalJSON encodes the problem as a JSON object with the members defined
+// by RFC 7807 section 3.1 followed by the extension members.
+func (problem Problem) MarshalJSON() ([]byte, error) {
+	members := map[string]interface{}{}
+	for name, value := range problem.Extensions {
+		members[name] = value
+	}
+	for name, value := range problem.members() {
+		members[name] = value
+	}
+	return json.Marshal(members)
+}
+
+// MarshalXML encodes the problem as described by RFC 7807 appendix A.
+func (problem Problem) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Space: "urn:ietf:rfc:7807", Local: "problem"}}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	members := problem.members()
+	names := []string{}
+	for _, name := range []string{"type", "title", "status", "detail", "instance"} {
+		if _, found := members[name]; found {
+			names = append(names, name)
+		}
+	}
+	extensions := []string{}
+	for name := range problem.Extensions {
+		if _, found := members[name]; !found {
+			members[name] = problem.Extensions[name]
+			extensions = append(extensions, name)
+		}
+	}
+	sort.Strings(extensions)
+	for _, name := range append(names, extensions...) {
+		if err := encodeXMLMember(e, name, members[name]); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// members returns the standard members of the problem that are present.
+func (problem Problem) members() map[string]interface{} {
+	members := map[string]interface{}{}
+	if problem.Type != "" {
+		members["type"] = problem.Type
+	}
+	if problem.Title != "" {
+		members["title"] = problem.Title
+	}
+	if problem.Status != 0 {
+		members["status"] = problem.Status
+	}
+	if problem.Detail != "" {
+		members["detail"] = problem.Detail
+	}
+	if problem.Instance != "" {
+		members["instance"] = problem.Instance
+	}
+	return members
+}
+
+// encodeXMLMember encodes a problem member as an XML element. Arrays are
+// encoded with an "i" element for each one of its items as suggested by
+// RFC 7807 appendix A.
+func encodeXMLMember(e *xml.Encoder, name string, value interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	v := reflect.ValueOf(value)
+	if (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) || v.Type().Elem().Kind() == reflect.Uint8 {
+		return e.EncodeElement(value, start)
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeXMLMember(e, "i", v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+// DefaultProblemMapper is the ProblemMapper used by view layers that do not
+// define their own. Problems found in the chain of the error are sent as they
+// are, validation errors are sent listing the errors of each field and any
+// other error is reported with the status given by StatusCode.
+// It does not disclose the messages of the errors to the clients.
+func DefaultProblemMapper(err error) *Problem {
+	var problem *Problem
+	if errors.As(err, &problem) {
+		return problem
+	}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		return validation.Problem()
+	}
+	status := StatusCode(err)
+	if status == http.StatusNotFound {
+		return NewProblem(status, "Item not found")
+	}
+	return NewProblem(status, "")
+}
+
+// StatusCode returns the status of the problem so problems can be wrapped by
+// other errors and still be reported with the right status.
+func (problem *Problem) StatusCode() int {
+	if problem.Status == 0 {
+		return http.StatusInternalServerError
+	}
+	return problem.Status
+}
+
+// problemMediaType returns the problem media type equivalent to the given
+// MIME type of a producer.
+func problemMediaType(mimeType string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	mainType, subType := splitMediaType(mediaType)
+	if i := strings.LastIndex(subType, "+"); i >= 0 {
+		subType = subType[i+1:]
+	}
+	switch {
+	case subType == "json":
+		return MIME_PROBLEM_JSON
+	case subType == "xml" && (mainType == "application" || mainType == "text"):
+		return MIME_PROBLEM_XML
+	}
+	return mimeType
+}
+
+// problemWriter is an http writer that replaces the content type set by a
+// producer with the equivalent problem media type.
+type problemWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *problemWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(HEADER_ContentType, w.contentType)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *problemWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// ProduceProblem writes the given problem to the http writer as an
+// "application/problem+json" or "application/problem+xml" response.
+// The producer is negotiated as in Produce but the default producer is used
+// instead of answering "406 Not Acceptable" when none of them is acceptable.
+func ProduceProblem(producer Producer, w http.ResponseWriter, r *http.Request, problem *Problem) {
+	status := problem.StatusCode()
+	AddVary(w.Header(), HEADER_Accept)
+	candidates := flattenProducers(producer)
+	if len(candidates) == 0 {
+		w.WriteHeader(status)
+		return
+	}
+	// Every producer is offered both with its own MIME type and with the
+	// equivalent problem media type
+	offers := make([]string, 2*len(candidates))
+	for i, candidate := range candidates {
+		offers[i] = problemMediaType(candidate.MimeType())
+		offers[len(candidates)+i] = candidate.MimeType()
+	}
+	selected := candidates[0]
+	if i := negotiate(r.Header.Get(HEADER_Accept), offers); i >= 0 {
+		selected = candidates[i%len(candidates)]
+	}
+	writer := &problemWriter{ResponseWriter: w, contentType: problemMediaType(selected.MimeType())}
+	out(selected, writer, r, status, problem)
+}
+
+// problemProducer writes the problems as JSON when there is no producer to
+// write them, like in Consume.
+type problemProducer struct{}
+
+func (producer problemProducer) MimeType() string {
+	return MIME_JSON
+}
+
+func (producer problemProducer) Out(w http.ResponseWriter, statusCode int, value interface{}) {
+	output, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(output)
+}
+
+// ProduceError writes the problem that the problem mapper of the view layer
+// gives for the error to the http writer. Errors the mapper does not know
+// about (it returns nil) are mapped by DefaultProblemMapper.
+func ProduceError(view ViewLayer, w http.ResponseWriter, r *http.Request, err error) {
+	var problem *Problem
+	if view.ProblemMapper != nil {
+		problem = view.ProblemMapper(err)
+	}
+	if problem == nil {
+		problem = DefaultProblemMapper(err)
+	}
+	ProduceProblem(view.Producer, w, r, problem)
+}
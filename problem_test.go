@@ -0,0 +1,218 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testXMLProducer writes the values as XML.
+type testXMLProducer struct{}
+
+func (producer testXMLProducer) MimeType() string {
+	return MIME_XML
+}
+
+func (producer testXMLProducer) Out(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.Header().Set(HEADER_ContentType, MIME_XML)
+	w.WriteHeader(statusCode)
+	xml.NewEncoder(w).Encode(value)
+}
+
+func forbidden() *Problem {
+	problem := NewProblem(http.StatusForbidden, "Your current balance is 30, but that costs 50.")
+	problem.Type = "https://example.com/probs/out-of-credit"
+	problem.Instance = "/account/12345/msgs/abc"
+	problem.Extensions = map[string]interface{}{
+		"balance":  30,
+		"accounts": []string{"/account/12345", "/account/67890"},
+		"status":   200,
+	}
+	return problem
+}
+
+func TestProblemMarshalJSON(t *testing.T) {
+	output, err := json.Marshal(forbidden())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"accounts":["/account/12345","/account/67890"],"balance":30,"detail":"Your current balance is 30, but that costs 50.","instance":"/account/12345/msgs/abc","status":403,"title":"Forbidden","type":"https://example.com/probs/out-of-credit"}`
+	if string(output) != want {
+		t.Errorf("got %s, want %s", output, want)
+	}
+
+	output, err = json.Marshal(&Problem{Status: http.StatusNotFound})
+	if err != nil || string(output) != `{"status":404}` {
+		t.Errorf("empty members: got %s, %v, want only the status", output, err)
+	}
+}
+
+func TestProblemMarshalXML(t *testing.T) {
+	output, err := xml.Marshal(forbidden())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<problem xmlns="urn:ietf:rfc:7807">` +
+		`<type>https://example.com/probs/out-of-credit</type>` +
+		`<title>Forbidden</title>` +
+		`<status>403</status>` +
+		`<detail>Your current balance is 30, but that costs 50.</detail>` +
+		`<instance>/account/12345/msgs/abc</instance>` +
+		`<accounts><i>/account/12345</i><i>/account/67890</i></accounts>` +
+		`<balance>30</balance>` +
+		`</problem>`
+	if string(output) != want {
+		t.Errorf("got %s, want %s", output, want)
+	}
+
+	problem := (&ValidationError{Errors: []FieldError{{Field: "name", Message: "is required"}}}).Problem()
+	output, err = xml.Marshal(problem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), `<errors><i><field>name</field><message>is required</message></i></errors>`) {
+		t.Errorf("validation: got %s, want the errors of each field", output)
+	}
+}
+
+func TestProblemMediaType(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{MIME_JSON, MIME_PROBLEM_JSON},
+		{"application/json; charset=utf-8", MIME_PROBLEM_JSON},
+		{"Application/JSON", MIME_PROBLEM_JSON},
+		{"application/vnd.skue+json", MIME_PROBLEM_JSON},
+		{MIME_XML, MIME_PROBLEM_XML},
+		{"text/xml", MIME_PROBLEM_XML},
+		{"application/atom+xml", MIME_PROBLEM_XML},
+		{"image/svg+xml", "image/svg+xml"},
+		{"text/html", "text/html"},
+		{"application/msgpack", "application/msgpack"},
+	}
+	for _, test := range tests {
+		if got := problemMediaType(test.mimeType); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.mimeType, got, test.want)
+		}
+	}
+}
+
+func TestProblemWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	writer := &problemWriter{ResponseWriter: w, contentType: MIME_PROBLEM_JSON}
+	writer.Header().Set(HEADER_ContentType, MIME_JSON)
+	writer.WriteHeader(http.StatusNotFound)
+	writer.Write([]byte("{}"))
+	if w.Code != http.StatusNotFound || w.Header().Get(HEADER_ContentType) != MIME_PROBLEM_JSON {
+		t.Errorf("got %d %q, want 404 %q", w.Code, w.Header().Get(HEADER_ContentType), MIME_PROBLEM_JSON)
+	}
+
+	w = httptest.NewRecorder()
+	writer = &problemWriter{ResponseWriter: w, contentType: MIME_PROBLEM_XML}
+	writer.Header().Set(HEADER_ContentType, MIME_XML)
+	writer.Write([]byte("<problem/>"))
+	if w.Code != http.StatusOK || w.Header().Get(HEADER_ContentType) != MIME_PROBLEM_XML {
+		t.Errorf("implicit header: got %d %q, want 200 %q", w.Code, w.Header().Get(HEADER_ContentType), MIME_PROBLEM_XML)
+	}
+}
+
+func TestProduceProblem(t *testing.T) {
+	producer := Producers{testProducer(MIME_JSON), testXMLProducer{}}
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", MIME_PROBLEM_JSON},
+		{"application/json", MIME_PROBLEM_JSON},
+		{"application/problem+json", MIME_PROBLEM_JSON},
+		{"application/xml", MIME_PROBLEM_XML},
+		{"application/problem+xml", MIME_PROBLEM_XML},
+		{"application/json;q=0.5, application/xml", MIME_PROBLEM_XML},
+		{"text/html", MIME_PROBLEM_JSON},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/players/1", nil)
+		r.Header.Set(HEADER_Accept, test.accept)
+		w := httptest.NewRecorder()
+		ProduceProblem(producer, w, r, forbidden())
+		if w.Code != http.StatusForbidden || w.Header().Get(HEADER_ContentType) != test.contentType {
+			t.Errorf("%q: got %d %q, want 403 %q", test.accept, w.Code, w.Header().Get(HEADER_ContentType), test.contentType)
+		}
+		if w.Header().Get(HEADER_Vary) != HEADER_Accept {
+			t.Errorf("%q: got Vary %q, want Accept", test.accept, w.Header().Get(HEADER_Vary))
+		}
+		body := w.Body.String()
+		if test.contentType == MIME_PROBLEM_XML && !strings.HasPrefix(body, `<problem xmlns="urn:ietf:rfc:7807">`) {
+			t.Errorf("%q: got %s, want an XML problem", test.accept, body)
+		}
+		if test.contentType == MIME_PROBLEM_JSON && !strings.Contains(body, `"balance":30`) {
+			t.Errorf("%q: got %s, want a JSON problem", test.accept, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ProduceProblem(Producers{}, w, httptest.NewRequest("GET", "/players/1", nil), NewProblem(http.StatusGone, ""))
+	if w.Code != http.StatusGone || w.Body.Len() != 0 {
+		t.Errorf("no producers: got %d %q, want 410 without body", w.Code, w.Body.String())
+	}
+}
+
+func TestDefaultProblemMapper(t *testing.T) {
+	gone := NewProblem(http.StatusGone, "The team was relegated")
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		detail string
+	}{
+		{"problem", gone, http.StatusGone, "The team was relegated"},
+		{"wrapped problem", fmt.Errorf("reading team: %w", gone), http.StatusGone, "The team was relegated"},
+		{"validation", &ValidationError{Errors: []FieldError{{Field: "name", Message: "is required"}}}, http.StatusUnprocessableEntity, "The item is not valid"},
+		{"not found", fmt.Errorf("reading team saprissa: %w", ErrNotFound), http.StatusNotFound, "Item not found"},
+		{"status coder", teapot{}, http.StatusTeapot, ""},
+		{"conflict", ErrConflict, http.StatusConflict, ""},
+		{"unknown", errors.New("password of the database is 1234"), http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		problem := DefaultProblemMapper(test.err)
+		if problem.Status != test.status || problem.Detail != test.detail {
+			t.Errorf("%s: got %d %q, want %d %q", test.name, problem.Status, problem.Detail, test.status, test.detail)
+		}
+		if problem.Title != statusText(test.status) {
+			t.Errorf("%s: got title %q, want %q", test.name, problem.Title, statusText(test.status))
+		}
+	}
+	if problem := DefaultProblemMapper(gone); problem != gone {
+		t.Errorf("problem: got %v, want the same problem", problem)
+	}
+	problem := DefaultProblemMapper(&ValidationError{Errors: []FieldError{{Field: "name", Message: "is required"}}})
+	if errs, ok := problem.Extensions["errors"].([]FieldError); !ok || len(errs) != 1 {
+		t.Errorf("validation: got extensions %v, want the errors of each field", problem.Extensions)
+	}
+}
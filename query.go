@@ -0,0 +1,223 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// FILTERING AND SORTING
+//
+// Lists can be filtered and sorted through the query parameters:
+//
+//    /teams?filter[country]=CR&filter[founded][gte]=1900&sort=-founded,name
+//
+// Only the fields declared by the persistors can be used, the parameters are
+// parsed into a Query that each persistor translates for its own storage.
+
+// FieldType is the type of the values of a field used in queries.
+type FieldType int
+
+const (
+	StringField FieldType = iota
+	IntField
+	FloatField
+	BoolField
+)
+
+// QueryField declares a field clients can filter by. Name is the name of the
+// field in the storage, the name used by the clients is used when empty.
+type QueryField struct {
+	Name     string
+	Type     FieldType
+	Sortable bool
+}
+
+// QueryFields is the allowlist of fields of a resource indexed by the name
+// used by the clients.
+type QueryFields map[string]QueryField
+
+// Queryable is implemented by persistors that allow clients to filter and
+// sort their lists. Only the returned fields can be used in queries.
+type Queryable interface {
+	QueryFields() QueryFields
+}
+
+// Filter operators
+const (
+	OpEqual          = "eq"
+	OpNotEqual       = "ne"
+	OpGreater        = "gt"
+	OpGreaterOrEqual = "gte"
+	OpLess           = "lt"
+	OpLessOrEqual    = "lte"
+	OpIn             = "in"
+)
+
+// Condition represents a condition items must meet to be included in a list.
+// Field is the name of the field in the storage and Value holds a string,
+// int64, float64 or bool value according to the type of the field, or a
+// slice of them for the "in" operator.
+type Condition struct {
+	Field    string
+	Operator string
+	Value    interface{}
+}
+
+// SortField represents a field used to sort a list.
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// Query represents the conditions all the items of a list must meet and the
+// order of the list.
+type Query struct {
+	Conditions []Condition
+	Sort       []SortField
+}
+
+// IsEmpty reports whether the query neither filters nor sorts.
+func (query Query) IsEmpty() bool {
+	return len(query.Conditions) == 0 && len(query.Sort) == 0
+}
+
+// notQueryable returns the error for the filter and sort parameters of the
+// lists that can not be filtered or sorted.
+func notQueryable() error {
+	return NewProblem(http.StatusBadRequest, "This list can not be filtered or sorted")
+}
+
+// badQuery returns the error for an invalid query parameter.
+func badQuery(format string, args ...interface{}) error {
+	return NewProblem(http.StatusBadRequest, fmt.Sprintf(format, args...))
+}
+
+// parseValue converts a value of a query parameter according to the type.
+func parseValue(fieldType FieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case IntField:
+		return strconv.ParseInt(value, 10, 64)
+	case FloatField:
+		return strconv.ParseFloat(value, 64)
+	case BoolField:
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// parseFilterKey parses a filter[field] or filter[field][operator] key.
+func parseFilterKey(key string) (field, operator string, ok bool) {
+	if !strings.HasPrefix(key, "filter[") || !strings.HasSuffix(key, "]") {
+		return "", "", false
+	}
+	parts := strings.Split(key[len("filter["):len(key)-1], "][")
+	switch len(parts) {
+	case 1:
+		return parts[0], OpEqual, true
+	case 2:
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// ParseQuery reads the filter and sort parameters of the request. Fields
+// that are not in the allowlist, unknown operators and values of the wrong
+// type are reported as a "400 Bad Request" problem.
+func ParseQuery(r *http.Request, fields QueryFields) (query Query, err error) {
+	params := r.URL.Query()
+	keys := []string{}
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name, operator, ok := parseFilterKey(key)
+		if !ok {
+			continue
+		}
+		field, allowed := fields[name]
+		if !allowed {
+			return query, badQuery("Filtering by %q is not allowed", name)
+		}
+		if field.Name == "" {
+			field.Name = name
+		}
+		switch operator {
+		case OpEqual, OpNotEqual, OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual, OpIn:
+		default:
+			return query, badQuery("Unknown filter operator %q", operator)
+		}
+		for _, raw := range params[key] {
+			condition := Condition{Field: field.Name, Operator: operator}
+			if operator == OpIn {
+				values := []interface{}{}
+				for _, item := range strings.Split(raw, ",") {
+					value, err := parseValue(field.Type, item)
+					if err != nil {
+						return query, badQuery("Invalid value %q for %q", item, name)
+					}
+					values = append(values, value)
+				}
+				condition.Value = values
+			} else {
+				condition.Value, err = parseValue(field.Type, raw)
+				if err != nil {
+					return query, badQuery("Invalid value %q for %q", raw, name)
+				}
+			}
+			query.Conditions = append(query.Conditions, condition)
+		}
+	}
+	for _, value := range params["sort"] {
+		for _, name := range strings.Split(value, ",") {
+			descending := strings.HasPrefix(name, "-")
+			name = strings.TrimPrefix(strings.TrimPrefix(name, "-"), "+")
+			if name == "" {
+				continue
+			}
+			field, allowed := fields[name]
+			if !allowed || !field.Sortable {
+				return query, badQuery("Sorting by %q is not allowed", name)
+			}
+			if field.Name == "" {
+				field.Name = name
+			}
+			query.Sort = append(query.Sort, SortField{Field: field.Name, Descending: descending})
+		}
+	}
+	return query, nil
+}
+
+// hasQueryParams reports whether the request has filter or sort parameters.
+func hasQueryParams(r *http.Request) bool {
+	for key := range r.URL.Query() {
+		if _, _, ok := parseFilterKey(key); ok || key == "sort" {
+			return true
+		}
+	}
+	return false
+}
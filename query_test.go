@@ -0,0 +1,107 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	fields := QueryFields{
+		"name":    {Type: StringField, Sortable: true},
+		"country": {Name: "address.country", Type: StringField},
+		"founded": {Type: IntField, Sortable: true},
+		"budget":  {Type: FloatField},
+		"active":  {Type: BoolField},
+	}
+	tests := []struct {
+		query string
+		want  Query
+		err   bool
+	}{
+		{"", Query{}, false},
+		{"limit=10&fields=name", Query{}, false},
+		{"filter[name]=Saprissa", Query{Conditions: []Condition{{"name", OpEqual, "Saprissa"}}}, false},
+		{"filter[country]=CR", Query{Conditions: []Condition{{"address.country", OpEqual, "CR"}}}, false},
+		{"filter[founded][gte]=1900&filter[founded][lt]=2000", Query{Conditions: []Condition{{"founded", OpGreaterOrEqual, int64(1900)}, {"founded", OpLess, int64(2000)}}}, false},
+		{"filter[budget][gt]=1.5", Query{Conditions: []Condition{{"budget", OpGreater, 1.5}}}, false},
+		{"filter[active]=true", Query{Conditions: []Condition{{"active", OpEqual, true}}}, false},
+		{"filter[name][ne]=Heredia", Query{Conditions: []Condition{{"name", OpNotEqual, "Heredia"}}}, false},
+		{"filter[founded][lte]=1935", Query{Conditions: []Condition{{"founded", OpLessOrEqual, int64(1935)}}}, false},
+		{"filter[founded][in]=1921,1935", Query{Conditions: []Condition{{"founded", OpIn, []interface{}{int64(1921), int64(1935)}}}}, false},
+		{"sort=-founded,name", Query{Sort: []SortField{{"founded", true}, {"name", false}}}, false},
+		{"sort=%2Bname", Query{Sort: []SortField{{"name", false}}}, false},
+		{"filter[founded]=old", Query{}, true},
+		{"filter[founded][in]=1921,old", Query{}, true},
+		{"filter[budget]=much", Query{}, true},
+		{"filter[active]=maybe", Query{}, true},
+		{"filter[name][like]=Sap", Query{}, true},
+		{"filter[coach]=Guimaraes", Query{}, true},
+		{"sort=country", Query{}, true},
+		{"sort=coach", Query{}, true},
+	}
+	for _, test := range tests {
+		query, err := ParseQuery(httptest.NewRequest("GET", "/teams?"+test.query, nil), fields)
+		if test.err {
+			if StatusCode(err) != http.StatusBadRequest {
+				t.Errorf("%q: got %v, want a 400 problem", test.query, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.query, err)
+		} else if !reflect.DeepEqual(query, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.query, query, test.want)
+		}
+	}
+}
+
+// teams is a model that lists its items all at once.
+type teams []string
+
+func (list *teams) Create() error                   { return nil }
+func (list *teams) Read(cache MemoryCacher) error   { return nil }
+func (list *teams) Update(cache MemoryCacher) error { return nil }
+func (list *teams) Delete(cache MemoryCacher) error { return nil }
+func (list *teams) List() (interface{}, error)      { return *list, nil }
+
+func TestListNotQueryable(t *testing.T) {
+	view := ViewLayer{Producer: testProducer(MIME_JSON)}
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"limit=10", http.StatusOK},
+		{"filter[name]=Saprissa", http.StatusBadRequest},
+		{"sort=name", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		List(view, &teams{"Saprissa", "Heredia"}, w, httptest.NewRequest("GET", "/teams?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%q: got status %d, want %d: %s", test.query, w.Code, test.status, w.Body)
+		}
+	}
+}
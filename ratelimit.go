@@ -0,0 +1,200 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"container/list"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// RATE LIMITING
+
+// RateLimit represents the state of the rate limit of a client after one of
+// its requests. RetryAfter tells how long the client must wait to be allowed
+// again when the request is not allowed.
+type RateLimit struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps track of the requests made by each client, each one
+// of them identified by a key. Take accounts for a new request of the client
+// and tells whether it is allowed given the limit of requests per window.
+type RateLimitStore interface {
+	Take(key string, limit int, window time.Duration) (RateLimit, error)
+}
+
+// RateLimiter limits the number of requests clients can make in a window of
+// time. Key identifies the client of a request, the requests with an empty
+// key share a single limit. When the store fails the requests are allowed,
+// so an outage of the store does not take the API down.
+// Keys must not be chosen freely by the clients, like an API key that is not
+// verified yet, or any client could escape the limit by sending a new key.
+type RateLimiter struct {
+	Limit  int
+	Window time.Duration
+	Store  RateLimitStore
+	Key    func(r *http.Request) string
+	View   ViewLayer
+}
+
+// NewRateLimiter creates a rate limiter allowing limit requests per window
+// to each client IP address. Rejected requests get a "429 Too Many Requests"
+// problem produced with the given view.
+func NewRateLimiter(limit int, window time.Duration, store RateLimitStore, view ViewLayer) *RateLimiter {
+	return &RateLimiter{
+		Limit:  limit,
+		Window: window,
+		Store:  store,
+		Key:    KeyByIP,
+		View:   view,
+	}
+}
+
+// KeyByIP identifies clients by their IP address.
+func KeyByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// KeyByHeader identifies clients by the value of the given header, like an
+// API key. The limiter must run after the key is verified.
+func KeyByHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Handler wraps the given handler limiting the rate of the requests. The
+// X-Rate-Limit-Limit and X-Rate-Limit-Remaining headers are sent with every
+// response and rejected requests get a Retry-After header as well.
+func (limiter *RateLimiter) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := limiter.Key(r)
+		limit, err := limiter.Store.Take(key, limiter.Limit, limiter.Window)
+		if err != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(HEADER_XRateLimitLimit, strconv.Itoa(limiter.Limit))
+		w.Header().Set(HEADER_XRateLimitRemaining, strconv.Itoa(limit.Remaining))
+		if !limit.Allowed {
+			// Retry-After is given in whole seconds, rounded up
+			seconds := int((limit.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set(HEADER_RetryAfter, strconv.Itoa(seconds))
+			ProduceProblem(limiter.View.Producer, w, r, NewProblem(http.StatusTooManyRequests, "Rate limit exceeded"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ----------------------------------------------------------------------------
+// MEMORY RATE LIMIT STORE
+
+// MemoryRateLimitStore is a RateLimitStore that keeps a token bucket for each
+// client in memory. Buckets hold up to limit tokens and are refilled at a
+// rate of limit tokens per window, each request takes one token.
+// The buckets of the clients idle for a whole window are full again, so they
+// are removed. MaxBuckets bounds the number of buckets, the buckets idle for
+// the longest time are removed when it is reached.
+// It is meant for single instance deployments, use a store shared by all the
+// instances otherwise.
+type MemoryRateLimitStore struct {
+	MaxBuckets int
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	order   *list.List // Most recently used first
+	now     func() time.Time
+}
+
+// tokenBucket represents the bucket of a client.
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	window  time.Duration
+}
+
+// NewMemoryRateLimitStore creates a new empty MemoryRateLimitStore keeping
+// up to 100000 buckets.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		MaxBuckets: 100000,
+		buckets:    map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// Take takes a token from the bucket of the client if there is any left.
+func (store *MemoryRateLimitStore) Take(key string, limit int, window time.Duration) (RateLimit, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := store.now()
+	store.sweep(now)
+	rate := float64(limit) / window.Seconds()
+	var bucket *tokenBucket
+	if element, found := store.buckets[key]; found {
+		store.order.MoveToFront(element)
+		bucket = element.Value.(*tokenBucket)
+	} else {
+		bucket = &tokenBucket{key: key, tokens: float64(limit), updated: now}
+		store.buckets[key] = store.order.PushFront(bucket)
+	}
+	bucket.window = window
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * rate
+	if bucket.tokens > float64(limit) {
+		bucket.tokens = float64(limit)
+	}
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return RateLimit{Allowed: false, Remaining: 0, RetryAfter: wait}, nil
+	}
+	bucket.tokens--
+	return RateLimit{Allowed: true, Remaining: int(bucket.tokens)}, nil
+}
+
+// sweep removes the buckets that are full again, and the ones idle for the
+// longest time while there are too many, so the store does not grow forever.
+func (store *MemoryRateLimitStore) sweep(now time.Time) {
+	for element := store.order.Back(); element != nil; element = store.order.Back() {
+		bucket := element.Value.(*tokenBucket)
+		full := now.Sub(bucket.updated) > bucket.window
+		if !full && (store.MaxBuckets <= 0 || store.order.Len() < store.MaxBuckets) {
+			return
+		}
+		store.order.Remove(element)
+		delete(store.buckets, bucket.key)
+	}
+}
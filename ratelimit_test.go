@@ -0,0 +1,156 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// clock is a time source moved by hand.
+type clock struct {
+	time time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.time
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := &clock{time.Now()}
+	store := NewMemoryRateLimitStore()
+	store.now = now.now
+	tests := []struct {
+		name      string
+		advance   time.Duration
+		allowed   bool
+		remaining int
+		retry     time.Duration
+	}{
+		{"first", 0, true, 2, 0},
+		{"second", 0, true, 1, 0},
+		{"third", 0, true, 0, 0},
+		{"empty", 0, false, 0, time.Second},
+		{"still empty", 500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+		{"refilled", 500 * time.Millisecond, true, 0, 0},
+		{"refilled twice", 2 * time.Second, true, 1, 0},
+	}
+	for _, test := range tests {
+		now.time = now.time.Add(test.advance)
+		limit, err := store.Take("client", 3, 3*time.Second)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if limit.Allowed != test.allowed || limit.Remaining != test.remaining || limit.RetryAfter != test.retry {
+			t.Errorf("%s: got %+v, want allowed %v, remaining %d, retry after %v", test.name, limit, test.allowed, test.remaining, test.retry)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	now := &clock{time.Now()}
+	store := NewMemoryRateLimitStore()
+	store.now = now.now
+	store.MaxBuckets = 2
+
+	store.Take("first", 1, time.Minute)
+	store.Take("second", 1, time.Minute)
+	store.Take("third", 1, time.Minute)
+	if _, found := store.buckets["first"]; found || len(store.buckets) != 2 {
+		t.Errorf("got %d buckets, want the 2 most recent ones", len(store.buckets))
+	}
+	// The bucket removed for MaxBuckets is a full one again
+	if limit, _ := store.Take("first", 1, time.Minute); !limit.Allowed {
+		t.Errorf("got the request of a removed bucket refused")
+	}
+
+	now.time = now.time.Add(2 * time.Minute)
+	store.MaxBuckets = 0
+	store.Take("fourth", 1, time.Minute)
+	if len(store.buckets) != 1 {
+		t.Errorf("got %d buckets after a window, want only the new one", len(store.buckets))
+	}
+}
+
+// brokenRateLimitStore fails every time.
+type brokenRateLimitStore struct{}
+
+func (brokenRateLimitStore) Take(key string, limit int, window time.Duration) (RateLimit, error) {
+	return RateLimit{}, errors.New("connection refused")
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := &clock{time.Now()}
+	store := NewMemoryRateLimitStore()
+	store.now = now.now
+	limiter := NewRateLimiter(2, 2*time.Second, store, *NewViewLayer(testProducer(MIME_JSON), nil))
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		name       string
+		remoteAddr string
+		status     int
+		remaining  string
+		retryAfter string
+	}{
+		{"first", "192.0.2.1:1234", http.StatusNoContent, "1", ""},
+		{"other port", "192.0.2.1:4321", http.StatusNoContent, "0", ""},
+		{"limited", "192.0.2.1:1234", http.StatusTooManyRequests, "0", "1"},
+		{"other client", "192.0.2.2:1234", http.StatusNoContent, "1", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		} else if got := w.Header().Get(HEADER_ContentType); test.status == http.StatusTooManyRequests && got != MIME_PROBLEM_JSON {
+			t.Errorf("%s: got %s %q, want %q", test.name, HEADER_ContentType, got, MIME_PROBLEM_JSON)
+		}
+		if got := w.Header().Get(HEADER_XRateLimitLimit); got != "2" {
+			t.Errorf("%s: got %s %q, want %q", test.name, HEADER_XRateLimitLimit, got, "2")
+		}
+		if got := w.Header().Get(HEADER_XRateLimitRemaining); got != test.remaining {
+			t.Errorf("%s: got %s %q, want %q", test.name, HEADER_XRateLimitRemaining, got, test.remaining)
+		}
+		if got := w.Header().Get(HEADER_RetryAfter); got != test.retryAfter {
+			t.Errorf("%s: got %s %q, want %q", test.name, HEADER_RetryAfter, got, test.retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterStoreDown(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Minute, brokenRateLimitStore{}, *NewViewLayer(testProducer(MIME_JSON), nil))
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("request %d: got status %d, want %d", i, w.Code, http.StatusNoContent)
+		}
+	}
+}
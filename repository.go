@@ -0,0 +1,252 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// ----------------------------------------------------------------------------
+// REPOSITORIES
+//
+// A Store keeps the items of a single type, so models do not need to repeat
+// the same persistence methods for each type. Items are plain structs with
+// one field tagged as their id:
+//
+//    type Team struct {
+//        TeamId string `skue:"id"`
+//        Name   string
+//    }
+//
+// ModelFactory adapts the items of a Store to the persistence utils, so a
+// Resource can serve them without writing any persistor.
+
+// PageOf is a page of typed items, see Page.
+type PageOf[T any] struct {
+	Items      []T
+	Total      int
+	NextCursor string
+	PrevCursor string
+}
+
+// Store keeps items of type T identified by values of type ID. Get, Update
+// and Delete return ErrNotFound when the item does not exist.
+type Store[T any, ID comparable] interface {
+	Create(ctx context.Context, item *T) error
+	Get(ctx context.Context, id ID) (*T, error)
+	Update(ctx context.Context, id ID, item *T) error
+	Delete(ctx context.Context, id ID) error
+	List(ctx context.Context, request ListRequest) (*PageOf[T], error)
+}
+
+// Repository is a Store of items identified by strings.
+type Repository[T any] interface {
+	Store[T, string]
+}
+
+// ItemID returns the id of the item, reporting whether the item has an id
+// field of type ID.
+func ItemID[T any, ID comparable](item *T) (id ID, ok bool) {
+	field, found := IDField(reflect.TypeOf(item))
+	if !found || item == nil {
+		return id, false
+	}
+	id, ok = reflect.ValueOf(item).Elem().FieldByIndex(field.Index).Interface().(ID)
+	return
+}
+
+// SetItemID sets the id of the item, reporting whether the item has an id
+// field of type ID.
+func SetItemID[T any, ID comparable](item *T, id ID) bool {
+	field, found := IDField(reflect.TypeOf(item))
+	if !found || item == nil {
+		return false
+	}
+	value := reflect.ValueOf(item).Elem().FieldByIndex(field.Index)
+	if value.Type() != reflect.TypeOf(id) {
+		return false
+	}
+	value.Set(reflect.ValueOf(id))
+	return true
+}
+
+// Model adapts an item kept in a Store to the DatabasePersistor interface.
+// The persistence utils decode, validate and produce the item itself, and
+// the hooks, Validator, Versioner, Timestamper and Queryable interfaces are
+// taken from the item. The cache given to the operations is not used, stores
+// handle their own caching.
+type Model[T any, ID comparable] struct {
+	Item  *T
+	ID    ID
+	Store Store[T, ID]
+	// found tells whether the id of the model is a valid id of the store
+	found bool
+}
+
+// ModelFactory returns a factory of the models of the items kept in the
+// store, like the one needed by a Resource. The ids of the requests are
+// translated by parseID, which may be nil when ID is string. Ids that can not
+// be translated belong to no item.
+func ModelFactory[T any, ID comparable](store Store[T, ID], parseID func(id string) (ID, error)) func(id string) DatabasePersistor {
+	return func(id string) DatabasePersistor {
+		model := &Model[T, ID]{Item: new(T), Store: store}
+		if id == "" {
+			return model
+		}
+		if parseID == nil {
+			model.ID, model.found = interface{}(id).(ID)
+		} else if parsed, err := parseID(id); err == nil {
+			model.ID, model.found = parsed, true
+		}
+		if model.found {
+			SetItemID(model.Item, model.ID)
+		}
+		return model
+	}
+}
+
+// item returns the item of the model.
+func (model *Model[T, ID]) item() interface{} {
+	return model.Item
+}
+
+func (model *Model[T, ID]) copyModel() DatabasePersistor {
+	copied := *model
+	copied.Item = new(T)
+	return &copied
+}
+
+// itemModel is implemented by models wrapping the item they persist.
+type itemModel interface {
+	item() interface{}
+}
+
+// modelItem returns the item wrapped by the model, or the model itself when
+// it does not wrap an item.
+func modelItem(model interface{}) interface{} {
+	if wrapper, ok := model.(itemModel); ok {
+		return wrapper.item()
+	}
+	return model
+}
+
+// ----------------------------------------------------------------------------
+// 			Model implementation of skue.DatabasePersistor
+// ----------------------------------------------------------------------------
+
+func (model *Model[T, ID]) Create() error {
+	return model.CreateContext(context.Background())
+}
+
+func (model *Model[T, ID]) Read(cache MemoryCacher) error {
+	return model.ReadContext(context.Background(), cache)
+}
+
+func (model *Model[T, ID]) Update(cache MemoryCacher) error {
+	return model.UpdateContext(context.Background(), cache)
+}
+
+func (model *Model[T, ID]) Delete(cache MemoryCacher) error {
+	return model.DeleteContext(context.Background(), cache)
+}
+
+func (model *Model[T, ID]) List() (interface{}, error) {
+	return model.ListContext(context.Background())
+}
+
+func (model *Model[T, ID]) ListPage(request ListRequest) (*Page, error) {
+	return model.ListPageContext(context.Background(), request)
+}
+
+// ----------------------------------------------------------------------------
+// 			Model implementation of skue.ContextDatabasePersistor
+// ----------------------------------------------------------------------------
+
+func (model *Model[T, ID]) CreateContext(ctx context.Context) error {
+	return model.Store.Create(ctx, model.Item)
+}
+
+func (model *Model[T, ID]) ReadContext(ctx context.Context, cache MemoryCacher) error {
+	if !model.found {
+		return ErrNotFound
+	}
+	item, err := model.Store.Get(ctx, model.ID)
+	if err != nil {
+		return err
+	}
+	*model.Item = *item
+	return nil
+}
+
+func (model *Model[T, ID]) UpdateContext(ctx context.Context, cache MemoryCacher) error {
+	if !model.found {
+		return ErrNotFound
+	}
+	// Like a patch, the body can not change the id of the item
+	if id, ok := ItemID[T, ID](model.Item); ok && id != model.ID {
+		return NewProblem(http.StatusUnprocessableEntity, "The id of the item can not be changed")
+	}
+	return model.Store.Update(ctx, model.ID, model.Item)
+}
+
+func (model *Model[T, ID]) DeleteContext(ctx context.Context, cache MemoryCacher) error {
+	if !model.found {
+		return ErrNotFound
+	}
+	return model.Store.Delete(ctx, model.ID)
+}
+
+// ListContext reads the whole list of items, page by page, following the
+// cursors of the store when it gives them.
+func (model *Model[T, ID]) ListContext(ctx context.Context) (interface{}, error) {
+	items := []T{}
+	request := ListRequest{Limit: MaxLimit}
+	for {
+		page, err := model.Store.List(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		switch {
+		case page.NextCursor != "":
+			request.Cursor = page.NextCursor
+		case request.Cursor != "" || len(page.Items) < request.Limit || (page.Total >= 0 && len(items) >= page.Total):
+			return items, nil
+		default:
+			request.Offset += len(page.Items)
+		}
+	}
+}
+
+func (model *Model[T, ID]) ListPageContext(ctx context.Context, request ListRequest) (*Page, error) {
+	page, err := model.Store.List(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return &Page{
+		Items:      page.Items,
+		Total:      page.Total,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}, nil
+}
@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+type club struct {
+	Code string `skue:"id"`
+	Name string
+}
+
+type badge struct {
+	Name string
+}
+
+func TestItemID(t *testing.T) {
+	item := &club{Code: "sap", Name: "Saprissa"}
+	if id, ok := ItemID[club, string](item); !ok || id != "sap" {
+		t.Errorf("got %q, %v, want %q, true", id, ok, "sap")
+	}
+	if _, ok := ItemID[club, int](item); ok {
+		t.Errorf("got the id of type int of an item with a string id")
+	}
+	if _, ok := ItemID[badge, string](&badge{}); ok {
+		t.Errorf("got the id of an item with no id field")
+	}
+	if _, ok := ItemID[club, string](nil); ok {
+		t.Errorf("got the id of a nil item")
+	}
+	if SetItemID(item, 1) || item.Code != "sap" {
+		t.Errorf("set an id of type int to an item with a string id")
+	}
+	if SetItemID(&badge{}, "sap") {
+		t.Errorf("set the id of an item with no id field")
+	}
+	if !SetItemID(item, "her") || item.Code != "her" {
+		t.Errorf("got id %q, want %q", item.Code, "her")
+	}
+}
+
+// pagedStore keeps the clubs in a slice, giving the pages by offset or, when
+// cursors is true, by cursor.
+type pagedStore struct {
+	clubs   []club
+	cursors bool
+	pages   int
+}
+
+func (store *pagedStore) Create(ctx context.Context, item *club) error {
+	store.clubs = append(store.clubs, *item)
+	return nil
+}
+
+func (store *pagedStore) Get(ctx context.Context, id string) (*club, error) {
+	for _, item := range store.clubs {
+		if item.Code == id {
+			return &item, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (store *pagedStore) Update(ctx context.Context, id string, item *club) error {
+	return nil
+}
+
+func (store *pagedStore) Delete(ctx context.Context, id string) error {
+	return nil
+}
+
+func (store *pagedStore) List(ctx context.Context, request ListRequest) (*PageOf[club], error) {
+	store.pages++
+	start := request.Offset
+	if request.Cursor != "" {
+		start, _ = strconv.Atoi(request.Cursor)
+	}
+	end := start + request.Limit
+	if end > len(store.clubs) {
+		end = len(store.clubs)
+	}
+	page := &PageOf[club]{Items: store.clubs[start:end], Total: -1}
+	if store.cursors && end < len(store.clubs) {
+		page.NextCursor = strconv.Itoa(end)
+	} else if !store.cursors {
+		page.Total = len(store.clubs)
+	}
+	return page, nil
+}
+
+func TestModelListContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		cursors bool
+		pages   int
+	}{
+		{"empty", 0, false, 1},
+		{"one page", MaxLimit - 1, false, 1},
+		{"full pages", 2 * MaxLimit, false, 2},
+		{"offsets", 2*MaxLimit + 1, false, 3},
+		{"cursors", 2*MaxLimit + 1, true, 3},
+	}
+	for _, test := range tests {
+		store := &pagedStore{cursors: test.cursors}
+		for i := 0; i < test.count; i++ {
+			store.clubs = append(store.clubs, club{Code: strconv.Itoa(i)})
+		}
+		model := ModelFactory[club, string](store, nil)("")
+		result, err := model.(*Model[club, string]).ListContext(context.Background())
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		items := result.([]club)
+		if len(items) != test.count || store.pages != test.pages {
+			t.Errorf("%s: got %d items in %d pages, want %d in %d", test.name, len(items), store.pages, test.count, test.pages)
+		}
+		for i, item := range items {
+			if item.Code != strconv.Itoa(i) {
+				t.Errorf("%s: got %s at %d", test.name, item.Code, i)
+				break
+			}
+		}
+	}
+}
+
+func TestModelFactory(t *testing.T) {
+	store := &pagedStore{clubs: []club{{Code: "1", Name: "Saprissa"}}}
+	factory := ModelFactory[club, string](store, func(id string) (string, error) {
+		if _, err := strconv.Atoi(id); err != nil {
+			return "", errors.New("invalid id")
+		}
+		return id, nil
+	})
+	ctx := context.Background()
+
+	model := factory("one").(*Model[club, string])
+	if err := model.ReadContext(ctx, nil); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("got %v reading an invalid id, want %v", err, ErrNotFound)
+	}
+	if err := model.UpdateContext(ctx, nil); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("got %v updating an invalid id, want %v", err, ErrNotFound)
+	}
+	if err := model.DeleteContext(ctx, nil); StatusCode(err) != http.StatusNotFound {
+		t.Errorf("got %v deleting an invalid id, want %v", err, ErrNotFound)
+	}
+
+	model = factory("1").(*Model[club, string])
+	if model.Item.Code != "1" {
+		t.Errorf("got id %q in the item, want %q", model.Item.Code, "1")
+	}
+	if err := model.ReadContext(ctx, nil); err != nil || model.Item.Name != "Saprissa" {
+		t.Errorf("got %+v, %v, want Saprissa", model.Item, err)
+	}
+	model.Item.Code = "2"
+	if err := model.UpdateContext(ctx, nil); StatusCode(err) != http.StatusUnprocessableEntity {
+		t.Errorf("got %v changing the id, want a 422 problem", err)
+	}
+}
@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// RESOURCES
+
+// Resource bundles the persistence utils to serve a REST resource as a
+// standard http.Handler, so it can be used with net/http ServeMux, martini
+// or any other router. The handler serves both the collection and its items:
+//
+//    GET, HEAD, POST       on the collection path
+//    GET, HEAD, PUT,
+//    PATCH, DELETE         on the item paths
+//
+// plus OPTIONS on both of them. Path is the path of the collection, its
+// segments starting with ":" match any value so nested resources like
+// "/teams/:team/players" can be served. Items are served at Path + "/" + id.
+// New creates the model for the item with the given id, an empty id is used
+// for new items and for listing the collection. ID extracts the id of the
+// item from a request, or returns "" for requests to the collection; when it
+// is nil the id is taken from the path of the request, and the requests to
+// other paths are answered with "404 Not Found".
+// Description is sent as the body of the responses to OPTIONS requests, if
+// not nil, to let clients discover the capabilities of the resource.
+// Hooks are called around the operations on the items of the resource, after
+// the hooks of the view.
+type Resource struct {
+	Path        string
+	New         func(id string) DatabasePersistor
+	ID          func(r *http.Request) string
+	View        ViewLayer
+	Cache       MemoryCacher
+	Description interface{}
+	Hooks       Hooks
+}
+
+// NewResource creates a new resource served at the given collection path.
+func NewResource(path string, view ViewLayer, factory func(id string) DatabasePersistor) *Resource {
+	return &Resource{
+		Path: path,
+		New:  factory,
+		View: view,
+	}
+}
+
+// splitPath returns the segments of the given path.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// PathID returns the id of the item the request refers to, according to the
+// path of the resource. Returns "" for requests to the collection, and false
+// when the path is neither the collection nor one of its items.
+func (resource *Resource) PathID(r *http.Request) (id string, ok bool) {
+	collection := splitPath(resource.Path)
+	segments := splitPath(r.URL.Path)
+	if len(segments) != len(collection) && len(segments) != len(collection)+1 {
+		return "", false
+	}
+	for i, segment := range collection {
+		if !strings.HasPrefix(segment, ":") && segment != segments[i] {
+			return "", false
+		}
+	}
+	if len(segments) == len(collection) {
+		return "", true
+	}
+	return segments[len(segments)-1], true
+}
+
+// id returns the id of the item the request refers to, and false when the
+// request does not refer to the resource.
+func (resource *Resource) id(r *http.Request) (string, bool) {
+	if resource.ID != nil {
+		return resource.ID(r), true
+	}
+	return resource.PathID(r)
+}
+
+// headWriter discards the body of the responses to HEAD requests.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (w headWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+// ServeHTTP dispatches the request to the persistence util for its method.
+func (resource *Resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	view := resource.View
+	id, ok := resource.id(r)
+	if !ok {
+		NotFound(view.Producer, w, r)
+		return
+	}
+	allowed := []string{"GET", "POST"}
+	if id != "" {
+		allowed = []string{"GET", "PUT", "PATCH", "DELETE"}
+	}
+	view.Hooks = view.Hooks.Add(resource.Hooks)
+	method := r.Method
+	if method == "HEAD" {
+		w = headWriter{w}
+		method = "GET"
+	}
+	switch {
+	case method == "GET" && id == "":
+		List(view, resource.New(""), w, r)
+	case method == "POST" && id == "":
+		Create(view, resource.New(""), w, r)
+	case method == "GET":
+		Read(view, resource.New(id), resource.Cache, w, r)
+	case method == "PUT" && id != "":
+		Update(view, resource.New(id), resource.Cache, w, r)
+	case method == "PATCH" && id != "":
+		Patch(view, resource.New(id), resource.Cache, w, r)
+	case method == "DELETE" && id != "":
+		Delete(view, resource.New(id), resource.Cache, w, r)
+	case method == "OPTIONS":
+		Options(view.Producer, w, r, resource.Description, allowed...)
+	default:
+		MethodNotAllowed(view.Producer, w, r, allowed...)
+	}
+}
@@ -21,7 +21,7 @@
 package skue
 
 import (
-	"io"
+	"errors"
 	"net/http"
 	"strings"
 )
@@ -30,14 +30,28 @@ import (
 // LIST OF CONSTANTS
 
 const (
-	MIME_XML  = "application/xml"
-	MIME_JSON = "application/json"
+	MIME_XML          = "application/xml"
+	MIME_JSON         = "application/json"
+	MIME_PROBLEM_XML  = "application/problem+xml"
+	MIME_PROBLEM_JSON = "application/problem+json"
+	MIME_MERGE_PATCH  = "application/merge-patch+json"
+	MIME_JSON_PATCH   = "application/json-patch+json"
 
+	HEADER_Vary                          = "Vary"
 	HEADER_Allow                         = "Allow"
 	HEADER_Accept                        = "Accept"
+	HEADER_AcceptPatch                   = "Accept-Patch"
 	HEADER_Origin                        = "Origin"
 	HEADER_ContentType                   = "Content-Type"
+	HEADER_ContentLength                 = "Content-Length"
+	HEADER_ETag                          = "ETag"
+	HEADER_IfMatch                       = "If-Match"
+	HEADER_IfNoneMatch                   = "If-None-Match"
+	HEADER_Link                          = "Link"
 	HEADER_LastModified                  = "Last-Modified"
+	HEADER_RetryAfter                    = "Retry-After"
+	HEADER_IfModifiedSince               = "If-Modified-Since"
+	HEADER_IfUnmodifiedSince             = "If-Unmodified-Since"
 	HEADER_AcceptEncoding                = "Accept-Encoding"
 	HEADER_ContentEncoding               = "Content-Encoding"
 	HEADER_AccessControlExposeHeaders    = "Access-Control-Expose-Headers"
@@ -47,8 +61,10 @@ const (
 	HEADER_AccessControlAllowOrigin      = "Access-Control-Allow-Origin"
 	HEADER_AccessControlAllowCredentials = "Access-Control-Allow-Credentials"
 	HEADER_AccessControlAllowHeaders     = "Access-Control-Allow-Headers"
+	HEADER_AccessControlMaxAge           = "Access-Control-Max-Age"
 	HEADER_XRateLimitLimit               = "X-Rate-Limit-Limit"
 	HEADER_XRateLimitRemaining           = "X-Rate-Limit-Remaining"
+	HEADER_XTotalCount                   = "X-Total-Count"
 )
 
 // SimpleMessage represents an HTTP simple response with
@@ -72,31 +88,59 @@ type Consumer interface {
 	In(r *http.Request, value interface{}) error
 }
 
+// Produce writes the given value to the http writer using the producer that
+// best matches the Accept header of the request. If the producer is composed
+// by several Producers the one with the highest quality value for the request
+// is chosen as described by RFC 7231 section 5.3.2.
+// The output is compressed when the client accepts it, see Compression.
 func Produce(producer Producer, w http.ResponseWriter, r *http.Request, status int, value interface{}) {
-	acceptEncoding := r.Header.Get(HEADER_Accept)
+	AddVary(w.Header(), HEADER_Accept)
+	selected, ok := Producers{producer}.Select(r.Header.Get(HEADER_Accept))
 	// According to HTTP/1.1 protocol section 14.1 about Accept header field
 	// "If an Accept header field is present, and if the server cannot send
 	// a response which is acceptable according to the combined Accept field
 	// value, then the server SHOULD send a 406 (not acceptable) response."
-	if acceptEncoding != "" && !strings.Contains(acceptEncoding, "*/*") {
-		if !strings.Contains(acceptEncoding, producer.MimeType()) {
-			w.WriteHeader(http.StatusNotAcceptable)
-			io.WriteString(w, "Not Acceptable")
-			return
-		}
+	// The problem is written by the first producer then.
+	if !ok {
+		ProduceProblem(producer, w, r, NewProblem(http.StatusNotAcceptable, ""))
+		return
 	}
-	producer.Out(w, status, value)
+	out(selected, w, r, status, value)
 }
 
+// ErrUnsupportedMediaType is returned by Consume when none of the consumers
+// can decode the content of the request. The "415 Unsupported Media Type"
+// problem is already written, as JSON, when this error is returned.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// Consume decodes the body of the request into the given value using the
+// consumer that matches the Content-Type header of the request. If the
+// consumer is composed by several Consumers the one registered for the
+// media type of the request is chosen.
+// Bodies compressed with gzip or deflate are decompressed transparently.
 func Consume(consumer Consumer, w http.ResponseWriter, r *http.Request, value interface{}) error {
-	contentType := r.Header.Get(HEADER_ContentType)
+	err := consume(consumer, r, value)
+	if err == ErrUnsupportedMediaType {
+		ProduceProblem(problemProducer{}, w, r, NewProblem(http.StatusUnsupportedMediaType, ""))
+	}
+	return err
+}
+
+// consume decodes the body of the request like Consume, but nothing is
+// written when the request can not be decoded.
+func consume(consumer Consumer, r *http.Request, value interface{}) error {
+	selected, ok := Consumers{consumer}.Select(r.Header.Get(HEADER_ContentType))
+	var err error
+	if ok {
+		err = decompressBody(r)
+	}
 	// According to HTTP/1.1 protocol section 14.17 about Content-Type header
-	if !strings.Contains(contentType, consumer.MimeType()) {
-		w.WriteHeader(http.StatusUnsupportedMediaType)
-		io.WriteString(w, "Unsupported Media Type")
-		return nil
+	if !ok || err == ErrUnsupportedMediaType {
+		return ErrUnsupportedMediaType
+	} else if err != nil {
+		return err
 	}
-	return consumer.In(r, value)
+	return selected.In(r, value)
 }
 
 // ServiceResponse is a convenience function to create an http response
@@ -111,11 +155,74 @@ func ServiceResponse(producer Producer, w http.ResponseWriter, r *http.Request,
 
 // NotAllowed handler will response with a "405 Method Not Allowed" response
 // It is a convenience handler to route all not allowed services
+// It does not know the methods supported by the route, use AllowedMethods
+// or MethodNotAllowed to send them to the client in the Allow header.
 func NotAllowed(producer Producer, w http.ResponseWriter, r *http.Request) {
-	ServiceResponse(producer, w, r, http.StatusMethodNotAllowed, "Method Not Allowed")
+	ProduceProblem(producer, w, r, NewProblem(http.StatusMethodNotAllowed, ""))
+}
+
+// SetAllow sets the Allow header with the given methods. OPTIONS is always
+// allowed and HEAD is allowed whenever GET is.
+func SetAllow(header http.Header, methods ...string) {
+	allowed := []string{}
+	seen := map[string]bool{}
+	add := func(method string) {
+		method = strings.ToUpper(method)
+		if !seen[method] {
+			seen[method] = true
+			allowed = append(allowed, method)
+		}
+	}
+	for _, method := range methods {
+		add(method)
+		if strings.ToUpper(method) == "GET" {
+			add("HEAD")
+		}
+	}
+	add("OPTIONS")
+	header.Set(HEADER_Allow, strings.Join(allowed, ", "))
+}
+
+// MethodNotAllowed responds with a "405 Method Not Allowed" response listing
+// the methods supported by the route in the Allow header, as required by
+// RFC 7231 section 6.5.5.
+func MethodNotAllowed(producer Producer, w http.ResponseWriter, r *http.Request, methods ...string) {
+	SetAllow(w.Header(), methods...)
+	ProduceProblem(producer, w, r, NewProblem(http.StatusMethodNotAllowed, ""))
+}
+
+// Options answers an OPTIONS request with the methods supported by the route
+// in the Allow header. The description, if not nil, is sent as the body of
+// the response so clients can discover the capabilities of the route,
+// otherwise the response is a "204 No Content".
+func Options(producer Producer, w http.ResponseWriter, r *http.Request, description interface{}, methods ...string) {
+	SetAllow(w.Header(), methods...)
+	if description == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	Produce(producer, w, r, http.StatusOK, description)
+}
+
+// AllowedMethods returns a handler for the routes supporting the given
+// methods. It answers OPTIONS requests and responds with a "405 Method Not
+// Allowed" response to any other request. It is a convenience handler to
+// route all not allowed services:
+//
+//    m.Get("/teams/:team", getTeam)
+//    m.Any("/teams/:team", skue.AllowedMethods(view.Producer, nil, "GET"))
+//
+func AllowedMethods(producer Producer, description interface{}, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			Options(producer, w, r, description, methods...)
+		} else {
+			MethodNotAllowed(producer, w, r, methods...)
+		}
+	}
 }
 
 // NotFound handler will respond with a "404 Not Found" response
 func NotFound(producer Producer, w http.ResponseWriter, r *http.Request) {
-	ServiceResponse(producer, w, r, http.StatusNotFound, "Item not found")
+	ProduceProblem(producer, w, r, NewProblem(http.StatusNotFound, "Item not found"))
 }
@@ -21,9 +21,11 @@
 package skue
 
 import (
+	"context"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
+	"time"
 )
 
 // MemoryCacher represents an abstraction of any memory caching system used
@@ -33,12 +35,37 @@ import (
 // - Redis: http://redis.io/
 // More info here:
 // Caching: http://en.wikipedia.org/wiki/Cache_(computing)
+// Get returns an error matching ErrCacheMiss when the key is not cached, and
+// one matching ErrUnavailable when the caching system is not working. The
+// persistors cache the value read after any other error of Get.
 type MemoryCacher interface {
 	Set(key interface{}, value interface{}) error
 	Get(key interface{}, value interface{}) error
 	Delete(key interface{}) error
 }
 
+// ExpiringCacher is a MemoryCacher that tells how long the values remain
+// cached, so persistors can refresh them before they expire, and that caches
+// values for a given time.
+// GetWithTTLContext decodes the cached value like GetContext and returns its
+// time to live, which is negative for the values that never expire.
+// SetWithTTLContext caches the value for the given time to live: a ttl of 0
+// uses the default time to live of the cacher and a negative ttl keeps the
+// value until it is deleted.
+type ExpiringCacher interface {
+	MemoryCacher
+	GetWithTTLContext(ctx context.Context, key interface{}, value interface{}) (time.Duration, error)
+	SetWithTTLContext(ctx context.Context, key interface{}, value interface{}, ttl time.Duration) error
+}
+
+// Locker is a lock shared by all the instances of an API, like the one
+// provided by the RedisCacher. Lock acquires the lock of the key for the
+// given time to live, returning ErrLocked if someone else holds it. The
+// returned function releases the lock.
+type Locker interface {
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func() error, err error)
+}
+
 // DatabasePersistor represents any abstraction that can follow the CRUD operations.
 // Create, Read, Update and Delete are the four basic operations
 // of persistent storage.
@@ -50,13 +77,28 @@ type DatabasePersistor interface {
 	List() (result interface{}, err error)
 }
 
-var ErrNotFound = errors.New("not found")
-
 // ViewLayer represents a consumer and a producer to decode and encode
-// Http requests and responses in a certain MIME type
+// Http requests and responses in a certain MIME type.
+// The producer could be composed by several Producers in order to negotiate
+// the MIME type of the responses and the consumer could be composed by several
+// Consumers in order to accept requests in different MIME types.
+//
+// Errors are sent to the clients as RFC 7807 problems, the ProblemMapper
+// decides the problem that corresponds to each error. DefaultProblemMapper
+// is used when it is nil.
+//
+// Hooks are called around the operations on every model handled through the
+// view, see Hooks.
+//
+// Errors that are not sent to the clients, like the causes of the bodies
+// that could not be read, are logged to the ErrorLog. The package ErrorLog is
+// used when it is nil.
 type ViewLayer struct {
-	Producer Producer
-	Consumer Consumer
+	Producer      Producer
+	Consumer      Consumer
+	ProblemMapper ProblemMapper
+	Hooks         Hooks
+	ErrorLog      *log.Logger
 }
 
 func NewViewLayer(producer Producer, consumer Consumer) *ViewLayer {
@@ -66,102 +108,314 @@ func NewViewLayer(producer Producer, consumer Consumer) *ViewLayer {
 	}
 }
 
+// AddConsumer registers another consumer in the view layer. Requests read
+// through the view are decoded by the consumer registered for the media type
+// given in their Content-Type header. The first consumer is the default one.
+func (view *ViewLayer) AddConsumer(consumer Consumer) {
+	switch current := view.Consumer.(type) {
+	case nil:
+		view.Consumer = consumer
+	case Consumers:
+		view.Consumer = append(append(Consumers{}, current...), consumer)
+	default:
+		view.Consumer = Consumers{current, consumer}
+	}
+}
+
+// AddProducer registers another producer in the view layer. Responses written
+// through the view are negotiated between all the registered producers using
+// the Accept header of each request. The first producer is the default one.
+func (view *ViewLayer) AddProducer(producer Producer) {
+	switch current := view.Producer.(type) {
+	case nil:
+		view.Producer = producer
+	case Producers:
+		view.Producer = append(append(Producers{}, current...), producer)
+	default:
+		view.Producer = Producers{current, producer}
+	}
+}
+
+// ErrorLog logs the errors that are not sent to the clients when the view
+// layer has no ErrorLog of its own, and the errors writing the compressed
+// responses. The standard logger is used when it is nil.
+var ErrorLog *log.Logger
+
+// logf logs an error that is not sent to the client to the given logger, or
+// to ErrorLog when it is nil.
+func logf(logger *log.Logger, format string, args ...interface{}) {
+	if logger == nil {
+		logger = ErrorLog
+	}
+	if logger != nil {
+		logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// logf logs an error of the view that is not sent to the client.
+func (view *ViewLayer) logf(format string, args ...interface{}) {
+	logf(view.ErrorLog, format, args...)
+}
+
+// runAfter runs the after hooks of an operation that is already done. Their
+// errors are logged, failing the response would make the client retry an
+// operation that succeeded.
+func (view *ViewLayer) runAfter(event HookEvent, model DatabasePersistor, r *http.Request) {
+	if err := view.Hooks.run(event, model, r); err != nil && !clientGone(r, err) {
+		view.logf("skue: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+}
+
+// readError is an error reading or decoding the body of a request.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return "failed reading from request: " + e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+// produceReadError answers "400 Bad Request" to a request whose body could
+// not be read. The errors of the decoders could reveal the internals of the
+// API, so the cause is logged and the client gets a fixed detail. Nothing is
+// logged when the client went away.
+func produceReadError(view ViewLayer, w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		ProduceProblem(view.Producer, w, r, NewProblem(http.StatusRequestEntityTooLarge, "The body of the request is too large"))
+		return
+	}
+	if clientGone(r, err) {
+		ProduceError(view, w, r, context.Canceled)
+		return
+	}
+	view.logf("skue: %s %s: %v", r.Method, r.URL.Path, err)
+	ProduceProblem(view.Producer, w, r, NewProblem(http.StatusBadRequest, "Failed reading from request"))
+}
+
 // ----------------------------------------------------------------------------
 // PERSISTANCE UTILS:  Handles models CRUD and interaction with HTTP
+//
+// The hooks of the view are called around each operation, see Hooks.
+// The context of the request is given to the models implementing
+// ContextDatabasePersistor, so their operations are cancelled when the client
+// goes away.
 
 // Saves a model to the underlying storage.
 // Internally it calls the Create method of the given model.
-// The model is constructed from the JSON body of the given request.
+// The model is constructed from the body of the given request and it is
+// only saved when it is valid, see Validate.
 // Writes to the http writer according to what happens with the model
 // following the REST architectural style.
 func Create(view ViewLayer, model DatabasePersistor, w http.ResponseWriter, r *http.Request) {
-	err := Consume(view.Consumer, w, r, &model)
+	err := consume(view.Consumer, r, modelItem(model))
 
-	if err != nil {
-		ServiceResponse(view.Producer, w, r, http.StatusBadRequest, fmt.Sprintf("Failed reading from request: %v", err))
+	if err == ErrUnsupportedMediaType {
+		ProduceError(view, w, r, err)
+	} else if err != nil {
+		produceReadError(view, w, r, err)
+	} else if err = view.Hooks.run(HOOK_BeforeCreate, model, r); err != nil {
+		ProduceError(view, w, r, err)
+	} else if err = Validate(modelItem(model)); err != nil {
+		ProduceError(view, w, r, err)
+	} else if err = ContextPersistor(model).CreateContext(r.Context()); err != nil {
+		ProduceError(view, w, r, err)
 	} else {
-		err = model.Create()
-		if err != nil {
-			ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Failed saving the item: %v", err))
-		} else {
-			Produce(view.Producer, w, r, http.StatusCreated, model)
-		}
+		view.runAfter(HOOK_AfterCreate, model, r)
+		produceFields(view, w, r, http.StatusCreated, model)
 	}
 }
 
 // Reads the model from underlying storage.
 // Internally it calls the Read method of the given model which assumes
 // it knows it's id.
+// Models implementing Versioner or Timestamper get a "304 Not Modified"
+// response for the requests with a matching If-None-Match or
+// If-Modified-Since header.
+// Only the fields requested by the client with the fields query parameter
+// are written.
 // Writes to the http writer according to what happens with the model
 // following the REST architectural style.
 func Read(view ViewLayer, model DatabasePersistor, cache MemoryCacher, w http.ResponseWriter, r *http.Request) {
-	err := model.Read(cache)
-	if err != nil {
-		if err.Error() == "not found" {
-			NotFound(view.Producer, w, r)
-		} else {
-			ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Failed reading the item: %v", err))
-		}
+	if err := readModel(view, model, cache, r); err != nil {
+		ProduceError(view, w, r, err)
 	} else {
-		Produce(view.Producer, w, r, http.StatusOK, model)
+		setValidators(w, model)
+		if notModified(model, r) {
+			AddVary(w.Header(), HEADER_Accept)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		produceFields(view, w, r, http.StatusOK, model)
 	}
 }
 
+// readModel reads the model running the BeforeRead and AfterRead hooks, so
+// the items the hooks keep from the client can not be changed by it either.
+func readModel(view ViewLayer, model DatabasePersistor, cache MemoryCacher, r *http.Request) error {
+	err := view.Hooks.run(HOOK_BeforeRead, model, r)
+	if err == nil {
+		err = ContextPersistor(model).ReadContext(r.Context(), cache)
+	}
+	if err == nil {
+		err = view.Hooks.run(HOOK_AfterRead, model, r)
+	}
+	return err
+}
+
 // Updates the given model in the underlying storage
 // Internally it calls the Update method of the given model.
-// The model is constructed from the JSON body of the given request.
+// The model is constructed from the body of the given request and it is
+// only updated when it is valid, see Validate.
+// The current state of the model is read first, into a copy of the model and
+// running the read hooks like Read, so the items the hooks keep from the
+// client can not be changed by it. The update is only done when the If-Match
+// and If-Unmodified-Since preconditions of the request are met, see
+// checkPreconditions.
 // Writes to the http writer according to what happens with the model
 // following the REST architectural style.
 func Update(view ViewLayer, model DatabasePersistor, cache MemoryCacher, w http.ResponseWriter, r *http.Request) {
-	err := Consume(view.Consumer, w, r, &model)
+	if err := checkPreconditions(view, copyModel(model), cache, r); err != nil && !isMissing(err) {
+		ProduceError(view, w, r, err)
+		return
+	}
+	err := consume(view.Consumer, r, modelItem(model))
 
+	if err == ErrUnsupportedMediaType {
+		ProduceError(view, w, r, err)
+	} else if err != nil {
+		produceReadError(view, w, r, err)
+	} else if err = view.Hooks.run(HOOK_BeforeUpdate, model, r); err != nil {
+		ProduceError(view, w, r, err)
+	} else if err = Validate(modelItem(model)); err != nil {
+		ProduceError(view, w, r, err)
+	} else if err = ContextPersistor(model).UpdateContext(r.Context(), cache); err != nil {
+		ProduceError(view, w, r, err)
+	} else {
+		view.runAfter(HOOK_AfterUpdate, model, r)
+		setValidators(w, model)
+		ServiceResponse(view.Producer, w, r, http.StatusOK, "Successfully updated")
+	}
+}
+
+// Patches the given model in the underlying storage.
+// Internally it calls the Read method of the given model which assumes
+// it knows it's id, running the read hooks like Read, applies the patch
+// document in the body of the request and then calls the Update method.
+// The patch document could be a JSON merge patch (RFC 7396) or a JSON patch
+// (RFC 6902) as told by the Content-Type of the request, and the patched
+// model is only updated when it is valid, see Validate.
+// The If-Match and If-Unmodified-Since preconditions of the request must be
+// met for the patch to be applied, see checkPreconditions.
+// Writes to the http writer according to what happens with the model
+// following the REST architectural style.
+func Patch(view ViewLayer, model DatabasePersistor, cache MemoryCacher, w http.ResponseWriter, r *http.Request) {
+	err := checkPreconditions(view, model, cache, r)
 	if err != nil {
-		ServiceResponse(view.Producer, w, r, http.StatusBadRequest, fmt.Sprintf("Failed reading from request: %v", err))
+		ProduceError(view, w, r, err)
 	} else {
-		err = model.Update(cache)
-		if err != nil {
-			if err.Error() == "not found" {
-				NotFound(view.Producer, w, r)
-			} else {
-				ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Failed updating the item: %v", err))
-			}
+		err = applyPatch(modelItem(model), r)
+		var read *readError
+		if err == ErrUnsupportedMediaType {
+			w.Header().Set(HEADER_AcceptPatch, MIME_MERGE_PATCH+", "+MIME_JSON_PATCH)
+			ProduceError(view, w, r, err)
+		} else if errors.As(err, &read) {
+			produceReadError(view, w, r, err)
+		} else if err != nil {
+			ProduceError(view, w, r, err)
+		} else if err = view.Hooks.run(HOOK_BeforeUpdate, model, r); err != nil {
+			ProduceError(view, w, r, err)
+		} else if err = Validate(modelItem(model)); err != nil {
+			ProduceError(view, w, r, err)
+		} else if err = ContextPersistor(model).UpdateContext(r.Context(), cache); err != nil {
+			ProduceError(view, w, r, err)
 		} else {
-			ServiceResponse(view.Producer, w, r, http.StatusOK, "Successfully updated")
+			view.runAfter(HOOK_AfterUpdate, model, r)
+			setValidators(w, model)
+			produceFields(view, w, r, http.StatusOK, model)
 		}
 	}
 }
 
 // Deletes the model in the underlying storage.
 // Internally it calls the Read method of the given model which assumes
-// it knows it's id.
-// If the model is created successfully then it calls the Delete method.
+// it knows it's id, running the read hooks like Read.
+// If the model is read successfully and the If-Match and
+// If-Unmodified-Since preconditions of the request are met then it calls
+// the Delete method, see checkPreconditions.
 // Writes to the http writer according to what happens with the model
 // following the REST architectural style.
 func Delete(view ViewLayer, model DatabasePersistor, cache MemoryCacher, w http.ResponseWriter, r *http.Request) {
-	err := model.Read(cache)
+	err := checkPreconditions(view, model, cache, r)
 	if err != nil {
-		if err.Error() == "not found" {
-			NotFound(view.Producer, w, r)
-		} else {
-			ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Failed retrieving the item: %v", err))
-		}
+		ProduceError(view, w, r, err)
+	} else if err = view.Hooks.run(HOOK_BeforeDelete, model, r); err != nil {
+		ProduceError(view, w, r, err)
+	} else if err = ContextPersistor(model).DeleteContext(r.Context(), cache); err != nil {
+		ProduceError(view, w, r, err)
 	} else {
-		err = model.Delete(cache)
-		if err != nil {
-			ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Failed deleting the item: %v", err))
-		} else {
-			ServiceResponse(view.Producer, w, r, http.StatusOK, "Successfully deleted")
-		}
+		view.runAfter(HOOK_AfterDelete, model, r)
+		ServiceResponse(view.Producer, w, r, http.StatusOK, "Successfully deleted")
 	}
 }
 
 // Returns the list of elements associated to the givem model in the underlying storage.
+// If the model implements Paginator only the page requested through the
+// limit, offset and cursor query parameters is returned, and the Link and
+// X-Total-Count headers tell the client how to reach the rest of the list.
+// If the model is also Queryable the list is filtered and sorted by the
+// filter and sort query parameters, the lists of any other model answer
+// "400 Bad Request" to them. The AfterList hooks may keep items of
+// the page from the client, in which case the page has fewer items.
+// Only the fields requested by the client with the fields query parameter
+// are written.
 // Writes to the http writer accordingly following the REST architectural style.
 func List(view ViewLayer, model DatabasePersistor, w http.ResponseWriter, r *http.Request) {
-	result, err := model.List()
+	if err := view.Hooks.run(HOOK_BeforeList, model, r); err != nil {
+		ProduceError(view, w, r, err)
+		return
+	}
+	if isPaginator(model) {
+		request, err := ParseListRequest(r)
+		request.Fields = ParseFields(r)
+		if queryable, ok := modelItem(model).(Queryable); ok && err == nil {
+			request.Query, err = ParseQuery(r, queryable.QueryFields())
+		} else if err == nil && hasQueryParams(r) {
+			err = notQueryable()
+		}
+		if err != nil {
+			ProduceError(view, w, r, err)
+			return
+		}
+		page, err := listPage(r.Context(), model, request)
+		if err == nil {
+			page.Items, err = view.Hooks.runAfterList(model, page.Items, r)
+		}
+		if err != nil {
+			ProduceError(view, w, r, err)
+		} else {
+			setPageHeaders(w, r, request, page)
+			produceFields(view, w, r, http.StatusOK, page.Items)
+		}
+		return
+	}
+	if hasQueryParams(r) {
+		ProduceError(view, w, r, notQueryable())
+		return
+	}
+	result, err := ContextPersistor(model).ListContext(r.Context())
+	if err == nil {
+		result, err = view.Hooks.runAfterList(model, result, r)
+	}
 	if err != nil {
-		ServiceResponse(view.Producer, w, r, http.StatusInternalServerError, fmt.Sprintf("Error requesting the list: %v", err))
+		ProduceError(view, w, r, err)
 	} else {
-		Produce(view.Producer, w, r, http.StatusOK, result)
+		produceFields(view, w, r, http.StatusOK, result)
 	}
 }
@@ -0,0 +1,374 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/greivinlopez/skue"
+	"github.com/greivinlopez/skue/cache/lru"
+	"github.com/greivinlopez/skue/database/memory"
+	"github.com/greivinlopez/skue/views"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The persistence utils are tested through a resource of players kept in a
+// memory store.
+
+type player struct {
+	Id   int    `json:"id" bson:"_id" skue:"id"`
+	Name string `json:"name" bson:"name"`
+	Team string `json:"team" bson:"team"`
+}
+
+// newPlayers creates the resource of players, the players of the "Secret"
+// team are kept from the clients by an AfterRead and an AfterList hook.
+func newPlayers() *skue.Resource {
+	store := memory.NewStore[player, int](memory.New(), "players", nil)
+	players := skue.NewResource("/players", *views.NewJSONView(), skue.ModelFactory[player, int](store, strconv.Atoi))
+	players.Hooks.AfterRead = []skue.HookFunc{func(model skue.DatabasePersistor, r *http.Request) error {
+		if model.(*skue.Model[player, int]).Item.Team == "Secret" {
+			return skue.ErrNotFound
+		}
+		return nil
+	}}
+	players.Hooks.AfterList = []skue.ListHookFunc{func(model skue.DatabasePersistor, items interface{}, r *http.Request) (interface{}, error) {
+		visible := []player{}
+		for _, item := range items.([]player) {
+			if item.Team != "Secret" {
+				visible = append(visible, item)
+			}
+		}
+		return visible, nil
+	}}
+	return players
+}
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		contains    string
+	}{
+		{"create", "POST", "/players", skue.MIME_JSON, `{"id": 1, "name": "Keylor", "team": "Saprissa"}`, http.StatusCreated, "Keylor"},
+		{"create duplicate", "POST", "/players", skue.MIME_JSON, `{"id": 1, "name": "Bryan"}`, http.StatusConflict, ""},
+		{"create unsupported media type", "POST", "/players", "text/plain", `id=2`, http.StatusUnsupportedMediaType, "Unsupported Media Type"},
+		{"create invalid body", "POST", "/players", skue.MIME_JSON, `{"id": `, http.StatusBadRequest, ""},
+		{"read", "GET", "/players/1", "", "", http.StatusOK, "Saprissa"},
+		{"read missing", "GET", "/players/2", "", "", http.StatusNotFound, ""},
+		{"read invalid id", "GET", "/players/one", "", "", http.StatusNotFound, ""},
+		{"update", "PUT", "/players/1", skue.MIME_JSON, `{"id": 1, "name": "Keylor", "team": "Real Madrid"}`, http.StatusOK, ""},
+		{"update id", "PUT", "/players/1", skue.MIME_JSON, `{"id": 2, "name": "Keylor"}`, http.StatusUnprocessableEntity, ""},
+		{"read updated", "GET", "/players/1", "", "", http.StatusOK, "Real Madrid"},
+		{"patch", "PATCH", "/players/1", skue.MIME_MERGE_PATCH, `{"team": "PSG"}`, http.StatusOK, "PSG"},
+		{"patch id", "PATCH", "/players/1", skue.MIME_MERGE_PATCH, `{"id": 2}`, http.StatusUnprocessableEntity, ""},
+		{"json patch", "PATCH", "/players/1", skue.MIME_JSON_PATCH, `[{"op": "test", "path": "/team", "value": "PSG"}, {"op": "replace", "path": "/name", "value": "Navas"}]`, http.StatusOK, "Navas"},
+		{"json patch failed test", "PATCH", "/players/1", skue.MIME_JSON_PATCH, `[{"op": "test", "path": "/team", "value": "Saprissa"}, {"op": "replace", "path": "/name", "value": "Keylor"}]`, http.StatusConflict, ""},
+		{"json patch malformed", "PATCH", "/players/1", skue.MIME_JSON_PATCH, `[{"op": "replace", "value": "Keylor"}]`, http.StatusBadRequest, ""},
+		{"read json patched", "GET", "/players/1", "", "", http.StatusOK, "Navas"},
+		{"list", "GET", "/players", "", "", http.StatusOK, "PSG"},
+		{"delete", "DELETE", "/players/1", "", "", http.StatusOK, ""},
+		{"read deleted", "GET", "/players/1", "", "", http.StatusNotFound, ""},
+		{"delete missing", "DELETE", "/players/1", "", "", http.StatusNotFound, ""},
+		{"other path", "GET", "/teams/1", "", "", http.StatusNotFound, ""},
+		{"create hidden", "POST", "/players", skue.MIME_JSON, `{"id": 3, "name": "Joel", "team": "Secret"}`, http.StatusCreated, ""},
+		{"read hidden", "GET", "/players/3", "", "", http.StatusNotFound, ""},
+		{"update hidden", "PUT", "/players/3", skue.MIME_JSON, `{"id": 3, "name": "Celso", "team": "Saprissa"}`, http.StatusNotFound, ""},
+		{"patch hidden", "PATCH", "/players/3", skue.MIME_MERGE_PATCH, `{"name": "Celso"}`, http.StatusNotFound, ""},
+		{"list hidden", "GET", "/players", "", "", http.StatusOK, "[]"},
+		{"read still hidden", "GET", "/players/3", "", "", http.StatusNotFound, ""},
+		{"delete hidden", "DELETE", "/players/3", "", "", http.StatusNotFound, ""},
+	}
+	players := newPlayers()
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.contentType != "" {
+			r.Header.Set(skue.HEADER_ContentType, test.contentType)
+		}
+		w := httptest.NewRecorder()
+		players.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		} else if !strings.Contains(w.Body.String(), test.contains) {
+			t.Errorf("%s: got %s, want it to contain %q", test.name, w.Body, test.contains)
+		}
+	}
+}
+
+// team is versioned, so the conditional requests can be tested.
+type team struct {
+	Id      string `json:"id" bson:"_id" skue:"id"`
+	Name    string `json:"name" bson:"name"`
+	Version int    `json:"version" bson:"version"`
+}
+
+func (team *team) ETag() string {
+	return strconv.Itoa(team.Version)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	persistor := memory.New()
+	store := memory.NewStore[team, string](persistor, "teams", lru.New(lru.Options{}))
+	teams := skue.NewResource("/teams", *views.NewJSONView(), skue.ModelFactory[team, string](store, nil))
+	store.Create(context.Background(), &team{Id: "saprissa", Name: "Saprissa", Version: 1})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		value  string
+		body   string
+		status int
+	}{
+		{"not modified", "GET", "/teams/saprissa", skue.HEADER_IfNoneMatch, `"1"`, "", http.StatusNotModified},
+		{"not modified weak", "GET", "/teams/saprissa", skue.HEADER_IfNoneMatch, `W/"1"`, "", http.StatusNotModified},
+		{"not modified any", "GET", "/teams/saprissa", skue.HEADER_IfNoneMatch, `"0", *`, "", http.StatusNotModified},
+		{"modified", "GET", "/teams/saprissa", skue.HEADER_IfNoneMatch, `"0"`, "", http.StatusOK},
+		{"update changed", "PUT", "/teams/saprissa", skue.HEADER_IfMatch, `"0"`, `{"name": "Saprissa", "version": 2}`, http.StatusPreconditionFailed},
+		{"update weak", "PUT", "/teams/saprissa", skue.HEADER_IfMatch, `W/"1"`, `{"name": "Saprissa", "version": 2}`, http.StatusPreconditionFailed},
+		{"update", "PUT", "/teams/saprissa", skue.HEADER_IfMatch, `"1"`, `{"name": "Saprissa", "version": 2}`, http.StatusOK},
+		{"read updated", "GET", "/teams/saprissa", skue.HEADER_IfNoneMatch, `"1"`, "", http.StatusOK},
+		{"update missing", "PUT", "/teams/heredia", skue.HEADER_IfMatch, "*", `{"name": "Heredia"}`, http.StatusPreconditionFailed},
+		{"patch missing", "PATCH", "/teams/heredia", skue.HEADER_IfMatch, "*", `{"name": "Heredia"}`, http.StatusPreconditionFailed},
+		{"delete missing", "DELETE", "/teams/heredia", skue.HEADER_IfMatch, "*", "", http.StatusPreconditionFailed},
+		{"delete missing unconditionally", "DELETE", "/teams/heredia", "", "", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		r.Header.Set(skue.HEADER_ContentType, skue.MIME_JSON)
+		if test.method == "PATCH" {
+			r.Header.Set(skue.HEADER_ContentType, skue.MIME_MERGE_PATCH)
+		}
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		teams.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+	}
+
+	// The preconditions are not checked against the stale cached copy
+	persistor.UpdateContext(context.Background(), nil, &team{Id: "saprissa", Name: "Saprissa", Version: 3}, "teams", "_id", "saprissa")
+	w := httptest.NewRecorder()
+	teams.ServeHTTP(w, httptest.NewRequest("GET", "/teams/saprissa", nil))
+	if got := w.Header().Get(skue.HEADER_ETag); got != `"2"` {
+		t.Fatalf("got ETag %s, want the cached %s", got, `"2"`)
+	}
+	r := httptest.NewRequest("DELETE", "/teams/saprissa", nil)
+	r.Header.Set(skue.HEADER_IfMatch, `"2"`)
+	w = httptest.NewRecorder()
+	teams.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete stale: got status %d, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	document := `{"name": "Keylor", "a/b": 1, "m~n": 2, "teams": ["Saprissa", "Real Madrid"], "stats": {"saves": 10}}`
+	tests := []struct {
+		name   string
+		patch  string
+		want   string
+		status int
+	}{
+		{"add", `[{"op": "add", "path": "/number", "value": 1}]`, `"number":1`, 0},
+		{"add to array", `[{"op": "add", "path": "/teams/1", "value": "Levante"}]`, `"teams":["Saprissa","Levante","Real Madrid"]`, 0},
+		{"add to the end", `[{"op": "add", "path": "/teams/-", "value": "PSG"}]`, `"teams":["Saprissa","Real Madrid","PSG"]`, 0},
+		{"remove", `[{"op": "remove", "path": "/teams/0"}]`, `"teams":["Real Madrid"]`, 0},
+		{"replace", `[{"op": "replace", "path": "/stats/saves", "value": 11}]`, `"stats":{"saves":11}`, 0},
+		{"move", `[{"op": "move", "from": "/stats/saves", "path": "/saves"}]`, `"saves":10,"stats":{}`, 0},
+		{"copy", `[{"op": "copy", "from": "/teams/0", "path": "/first"}]`, `"first":"Saprissa"`, 0},
+		{"test", `[{"op": "test", "path": "/stats", "value": {"saves": 10}}]`, `"name":"Keylor"`, 0},
+		{"escaped slash", `[{"op": "replace", "path": "/a~1b", "value": 3}]`, `"a/b":3`, 0},
+		{"escaped tilde", `[{"op": "remove", "path": "/m~0n"}]`, `"a/b":1,"name"`, 0},
+		{"failed test", `[{"op": "test", "path": "/name", "value": "Navas"}]`, "", http.StatusConflict},
+		{"failed test is atomic", `[{"op": "replace", "path": "/name", "value": "Navas"}, {"op": "test", "path": "/teams/0", "value": "PSG"}]`, "", http.StatusConflict},
+		{"move into a child", `[{"op": "move", "from": "/stats", "path": "/stats/old"}]`, "", http.StatusBadRequest},
+		{"move missing", `[{"op": "move", "from": "/missing", "path": "/found"}]`, "", http.StatusConflict},
+		{"index out of range", `[{"op": "replace", "path": "/teams/2", "value": "PSG"}]`, "", http.StatusConflict},
+		{"add out of range", `[{"op": "add", "path": "/teams/3", "value": "PSG"}]`, "", http.StatusConflict},
+		{"remove the end", `[{"op": "remove", "path": "/teams/-"}]`, "", http.StatusBadRequest},
+		{"leading zero", `[{"op": "remove", "path": "/teams/01"}]`, "", http.StatusBadRequest},
+		{"missing member", `[{"op": "remove", "path": "/number"}]`, "", http.StatusConflict},
+		{"unknown operation", `[{"op": "merge", "path": "/name"}]`, "", http.StatusBadRequest},
+		{"invalid pointer", `[{"op": "remove", "path": "name"}]`, "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		patched, err := skue.JSONPatch([]byte(document), []byte(test.patch))
+		if test.status != 0 {
+			if status := skue.StatusCode(err); status != test.status {
+				t.Errorf("%s: got %v with status %d, want status %d", test.name, err, status, test.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		} else if !strings.Contains(string(patched), test.want) {
+			t.Errorf("%s: got %s, want it to contain %s", test.name, patched, test.want)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	players := newPlayers()
+	logged := &bytes.Buffer{}
+	players.View.ErrorLog = log.New(logged, "", 0)
+	players.Hooks.BeforeDelete = []skue.HookFunc{func(model skue.DatabasePersistor, r *http.Request) error {
+		return skue.ErrForbidden
+	}}
+	players.Hooks.AfterCreate = []skue.HookFunc{func(model skue.DatabasePersistor, r *http.Request) error {
+		return errors.New("audit failed")
+	}}
+
+	r := httptest.NewRequest("POST", "/players", strings.NewReader(`{"id": 1, "name": "Keylor"}`))
+	r.Header.Set(skue.HEADER_ContentType, skue.MIME_JSON)
+	w := httptest.NewRecorder()
+	players.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated {
+		t.Errorf("create: got status %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if !strings.Contains(logged.String(), "audit failed") {
+		t.Errorf("create: got %q logged, want the error of the AfterCreate hook", logged)
+	}
+
+	w = httptest.NewRecorder()
+	players.ServeHTTP(w, httptest.NewRequest("DELETE", "/players/1", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("delete: got status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	w = httptest.NewRecorder()
+	players.ServeHTTP(w, httptest.NewRequest("GET", "/players/1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("read after forbidden delete: got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	skue.MaxBodySize = 16
+	defer func() { skue.MaxBodySize = 0 }()
+	r := httptest.NewRequest("POST", "/players", strings.NewReader(`{"id": 1, "name": "Keylor Antonio Navas Gamboa"}`))
+	r.Header.Set(skue.HEADER_ContentType, skue.MIME_JSON)
+	w := httptest.NewRecorder()
+	newPlayers().ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusRequestEntityTooLarge, w.Body)
+	}
+}
+
+func TestResourceClientGone(t *testing.T) {
+	players := newPlayers()
+	logged := &bytes.Buffer{}
+	players.View.ErrorLog = log.New(logged, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/players/1", ""},
+		{"POST", "/players", `{"id": 1, "name": "Keylor"}`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)).WithContext(ctx)
+		r.Header.Set(skue.HEADER_ContentType, skue.MIME_JSON)
+		w := httptest.NewRecorder()
+		players.ServeHTTP(w, r)
+		if w.Code != skue.StatusClientClosedRequest {
+			t.Errorf("%s %s: got status %d, want %d: %s", test.method, test.path, w.Code, skue.StatusClientClosedRequest, w.Body)
+		}
+	}
+	if logged.Len() > 0 {
+		t.Errorf("got %q logged, want nothing", logged)
+	}
+}
+
+func TestResourceMethods(t *testing.T) {
+	players := newPlayers()
+	r := httptest.NewRequest("POST", "/players", strings.NewReader(`{"id": 1, "name": "Keylor", "team": "Saprissa"}`))
+	r.Header.Set(skue.HEADER_ContentType, skue.MIME_JSON)
+	players.ServeHTTP(httptest.NewRecorder(), r)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		allow  string
+		body   bool
+	}{
+		{"put collection", "PUT", "/players", http.StatusMethodNotAllowed, "GET, HEAD, POST, OPTIONS", true},
+		{"delete collection", "DELETE", "/players", http.StatusMethodNotAllowed, "GET, HEAD, POST, OPTIONS", true},
+		{"post item", "POST", "/players/1", http.StatusMethodNotAllowed, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", true},
+		{"trace item", "TRACE", "/players/1", http.StatusMethodNotAllowed, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", true},
+		{"options collection", "OPTIONS", "/players", http.StatusNoContent, "GET, HEAD, POST, OPTIONS", false},
+		{"options item", "OPTIONS", "/players/1", http.StatusNoContent, "GET, HEAD, PUT, PATCH, DELETE, OPTIONS", false},
+		{"head collection", "HEAD", "/players", http.StatusOK, "", false},
+		{"head item", "HEAD", "/players/1", http.StatusOK, "", false},
+		{"head missing", "HEAD", "/players/2", http.StatusNotFound, "", false},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		players.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if got := w.Header().Get(skue.HEADER_Allow); got != test.allow {
+			t.Errorf("%s: got Allow %q, want %q", test.name, got, test.allow)
+		}
+		if got := w.Body.Len() > 0; got != test.body {
+			t.Errorf("%s: got body %q, want body %v", test.name, w.Body, test.body)
+		}
+	}
+
+	// HEAD answers with the headers of GET
+	get := httptest.NewRecorder()
+	players.ServeHTTP(get, httptest.NewRequest("GET", "/players/1", nil))
+	head := httptest.NewRecorder()
+	players.ServeHTTP(head, httptest.NewRequest("HEAD", "/players/1", nil))
+	if head.Header().Get(skue.HEADER_ContentType) != get.Header().Get(skue.HEADER_ContentType) {
+		t.Errorf("head: got Content-Type %q, want %q", head.Header().Get(skue.HEADER_ContentType), get.Header().Get(skue.HEADER_ContentType))
+	}
+
+	players.Description = map[string]string{"description": "The players of the league"}
+	w := httptest.NewRecorder()
+	players.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/players", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "players of the league") {
+		t.Errorf("options with description: got %d %s, want 200 with the description", w.Code, w.Body)
+	}
+	if w.Header().Get(skue.HEADER_Allow) != "GET, HEAD, POST, OPTIONS" {
+		t.Errorf("options with description: got Allow %q", w.Header().Get(skue.HEADER_Allow))
+	}
+}
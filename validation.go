@@ -0,0 +1,347 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// VALIDATION
+//
+// Models are validated by Create, Update and Patch before being persisted.
+// The rules are declared with the validate tag of the struct fields:
+//
+//    type Player struct {
+//        FirstName string `validate:"required,max=50"`
+//        Age       int    `validate:"min=15,max=60"`
+//        Foot      string `validate:"enum=Left|Right"`
+//        Email     string `validate:"regex=^[^@]+@[^@]+$"`
+//    }
+//
+//    required   the value is not the zero value of its type
+//    min, max   bounds of numbers, or of the length of strings and slices
+//    len        exact length of strings and slices
+//    enum       the value is one of the values separated by "|"
+//    regex      the string matches the regular expression, it must be the
+//               last rule of the tag
+//
+// Only the required rule is checked for nil pointers, so pointer fields can
+// be used for optional values.
+//
+// Nested structs are validated too, and models can implement Validator to
+// check anything the tags can not express.
+
+// Validator is implemented by models with their own validation rules.
+// Returning a *ValidationError reports the errors of each field, any other
+// error is reported as an error of the whole model.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes why the value of a field is not valid. Field is the
+// path of the field as named by the clients, like "Players[2].Age".
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+// ValidationError holds all the errors found validating a model. It matches
+// ErrValidationFailed and it is reported to the clients as a "422
+// Unprocessable Entity" problem listing the errors of each field.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, fieldError := range e.Errors {
+		if fieldError.Field == "" {
+			messages = append(messages, fieldError.Message)
+		} else {
+			messages = append(messages, fieldError.Field+": "+fieldError.Message)
+		}
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidationFailed
+}
+
+func (e *ValidationError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// Problem returns the problem reported to the clients for the error.
+func (e *ValidationError) Problem() *Problem {
+	problem := NewProblem(http.StatusUnprocessableEntity, "The item is not valid")
+	problem.Extensions = map[string]interface{}{"errors": e.Errors}
+	return problem
+}
+
+// Add adds an error for the given field.
+func (e *ValidationError) Add(field, message string) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: message})
+}
+
+// regexps caches the compiled regular expressions of the regex rules.
+var regexps = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: map[string]*regexp.Regexp{}}
+
+// compileRegexp returns the compiled regular expression for the pattern.
+func compileRegexp(pattern string) (*regexp.Regexp, error) {
+	regexps.Lock()
+	defer regexps.Unlock()
+	if compiled, found := regexps.compiled[pattern]; found {
+		return compiled, nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err == nil {
+		regexps.compiled[pattern] = compiled
+	}
+	return compiled, err
+}
+
+// Validate checks the rules declared in the validate tags of the value and
+// the Validate method of the values implementing Validator. All the errors
+// found are returned in a *ValidationError, nil is returned if the value is
+// valid. Invalid rules are reported with a plain error.
+func Validate(value interface{}) error {
+	validation := &ValidationError{}
+	if err := validateValue(reflect.ValueOf(value), "", validation); err != nil {
+		return err
+	}
+	if len(validation.Errors) > 0 {
+		return validation
+	}
+	return nil
+}
+
+// joinPath returns the path of a field of the value at the given path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// callValidator calls the Validate method of the value, if any, adding the
+// errors found to the validation.
+func callValidator(value reflect.Value, path string, validation *ValidationError) {
+	if value.CanAddr() {
+		value = value.Addr()
+	}
+	if !value.CanInterface() {
+		return
+	}
+	validator, ok := value.Interface().(Validator)
+	if !ok {
+		return
+	}
+	if err := validator.Validate(); err != nil {
+		if fieldErrors, ok := err.(*ValidationError); ok {
+			for _, fieldError := range fieldErrors.Errors {
+				validation.Add(joinPath(path, fieldError.Field), fieldError.Message)
+			}
+		} else {
+			validation.Add(path, err.Error())
+		}
+	}
+}
+
+// validateValue validates the value at the given path adding the errors
+// found to the validation.
+func validateValue(value reflect.Value, path string, validation *ValidationError) error {
+	if !value.IsValid() {
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return validateValue(value.Elem(), path, validation)
+	}
+	callValidator(value, path, validation)
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := validateValue(value.Index(i), fmt.Sprintf("%s[%d]", path, i), validation); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return validateFields(value, path, validation)
+	}
+	return nil
+}
+
+// validateFields validates the fields of a struct.
+func validateFields(value reflect.Value, path string, validation *ValidationError) error {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldPath := joinPath(path, FieldName(field))
+		if field.Anonymous {
+			fieldPath = path
+		}
+		if err := checkRules(value.Field(i), field.Tag.Get("validate"), fieldPath, validation); err != nil {
+			return err
+		}
+		if err := validateValue(value.Field(i), fieldPath, validation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRules splits the rules of a validate tag. The regex rule takes the
+// rest of the tag so its pattern can contain commas.
+func parseRules(tag string) [][2]string {
+	rules := [][2]string{}
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regex=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		pair := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(pair) == 1 {
+			pair = append(pair, "")
+		}
+		if pair[0] != "" {
+			rules = append(rules, [2]string{pair[0], pair[1]})
+		}
+	}
+	return rules
+}
+
+// measure returns the number that the min and max rules compare: the value
+// of numbers or the length of strings, slices and maps.
+func measure(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	case reflect.String:
+		return float64(len([]rune(value.String()))), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(value.Len()), true
+	}
+	return 0, false
+}
+
+// isText reports whether the value is compared by its length.
+func isText(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return true
+	}
+	return false
+}
+
+// checkRules checks the rules of a validate tag against the value. Nil
+// pointers are optional values left out, only the required rule is checked
+// for them.
+func checkRules(value reflect.Value, tag string, path string, validation *ValidationError) error {
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	omitted := value.Kind() == reflect.Ptr
+	for _, rule := range parseRules(tag) {
+		name, argument := rule[0], rule[1]
+		if omitted && name != "required" {
+			continue
+		}
+		switch name {
+		case "required":
+			if value.IsZero() {
+				validation.Add(path, "is required")
+				return nil
+			}
+		case "min", "max", "len":
+			limit, err := strconv.ParseFloat(argument, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s rule for %s: %q", name, path, argument)
+			}
+			measured, ok := measure(value)
+			if !ok {
+				return fmt.Errorf("the %s rule can not be used with %s", name, path)
+			}
+			unit := ""
+			if isText(value) {
+				unit = " in length"
+			}
+			switch {
+			case name == "min" && measured < limit:
+				validation.Add(path, fmt.Sprintf("must be at least %s%s", argument, unit))
+			case name == "max" && measured > limit:
+				validation.Add(path, fmt.Sprintf("must be at most %s%s", argument, unit))
+			case name == "len" && measured != limit:
+				validation.Add(path, fmt.Sprintf("must be exactly %s in length", argument))
+			}
+		case "enum":
+			current := fmt.Sprint(value.Interface())
+			found := false
+			for _, option := range strings.Split(argument, "|") {
+				if option == current {
+					found = true
+					break
+				}
+			}
+			if !found {
+				validation.Add(path, "must be one of "+strings.Replace(argument, "|", ", ", -1))
+			}
+		case "regex":
+			if value.Kind() != reflect.String {
+				return fmt.Errorf("the regex rule can not be used with %s", path)
+			}
+			pattern, err := compileRegexp(argument)
+			if err != nil {
+				return fmt.Errorf("invalid regex rule for %s: %v", path, err)
+			}
+			if !pattern.MatchString(value.String()) {
+				validation.Add(path, "has an invalid format")
+			}
+		default:
+			return fmt.Errorf("unknown validation rule %q for %s", name, path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2013 Greivin López
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package skue
+
+import (
+	"errors"
+	"testing"
+)
+
+type validated struct {
+	Name  string  `validate:"required,max=5"`
+	Age   *int    `validate:"min=15,max=60"`
+	Foot  *string `validate:"enum=Left|Right"`
+	Email *string `validate:"required,regex=^[^@]+@[^@]+$"`
+}
+
+func TestValidate(t *testing.T) {
+	age, young, foot, email := 20, 10, "Up", "keylor@example.com"
+	tests := []struct {
+		name   string
+		value  validated
+		fields []string
+	}{
+		{"valid", validated{Name: "Bryan", Age: &age, Email: &email}, nil},
+		{"too long", validated{Name: "Keylor", Email: &email}, []string{"Name"}},
+		{"optional omitted", validated{Name: "Bryan", Email: &email}, nil},
+		{"optional given", validated{Name: "Bryan", Age: &young, Foot: &foot, Email: &email}, []string{"Age", "Foot"}},
+		{"required omitted", validated{Name: "Bryan"}, []string{"Email"}},
+	}
+	for _, test := range tests {
+		err := Validate(&test.value)
+		if test.fields == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		var validation *ValidationError
+		if !errors.As(err, &validation) {
+			t.Errorf("%s: got %v, want a validation error", test.name, err)
+			continue
+		}
+		if len(validation.Errors) != len(test.fields) {
+			t.Errorf("%s: got %v, want errors for %v", test.name, validation.Errors, test.fields)
+			continue
+		}
+		for i, field := range test.fields {
+			if validation.Errors[i].Field != field {
+				t.Errorf("%s: got %v, want errors for %v", test.name, validation.Errors, test.fields)
+			}
+		}
+	}
+}
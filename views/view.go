@@ -0,0 +1,16 @@
+package views
+
+import (
+	"github.com/greivinlopez/skue"
+)
+
+// NewView creates a view layer that consumes and produces either JSON or XML
+// content. Requests are decoded according to their Content-Type header and
+// responses are encoded according to the Accept header of each request.
+// JSON is used when the client does not have any preference.
+func NewView() *skue.ViewLayer {
+	view := skue.NewViewLayer(JSONProducer{}, JSONConsumer{})
+	view.AddProducer(XmlProducer{})
+	view.AddConsumer(XmlConsumer{})
+	return view
+}